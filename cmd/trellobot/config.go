@@ -13,14 +13,22 @@ type ListenerConfig struct {
 	LastActivityId string   `json:"lastActivityId"`
 }
 
+type WebhookConfig struct {
+	ListenAddr  string `json:"listenAddr"`
+	CallbackURL string `json:"callbackUrl"`
+	Secret      string `json:"secret"`
+}
+
 type AppConfig struct {
-	CmdPrefix    string           `json:"cmdPrefix"`
-	DiscordToken string           `json:"discordToken"`
-	AdminRoles   []string         `json:"adminRoles"`
-	TrelloApiKey string           `json:"trelloApiKey"`
-	TrelloToken  string           `json:"trelloToken"`
-	PollInterval int              `json:"pollInterval"`
-	Listeners    []ListenerConfig `json:"listeners"`
+	CmdPrefix       string           `json:"cmdPrefix"`
+	DiscordToken    string           `json:"discordToken"`
+	AdminRoles      []string         `json:"adminRoles"`
+	TrelloApiKey    string           `json:"trelloApiKey"`
+	TrelloToken     string           `json:"trelloToken"`
+	PollInterval    int              `json:"pollInterval"`
+	PollMaxInterval int              `json:"pollMaxInterval"`
+	Listeners       []ListenerConfig `json:"listeners"`
+	Webhook         *WebhookConfig   `json:"webhook"`
 }
 
 func loadConfig(cfgFile string) (*AppConfig, error) {
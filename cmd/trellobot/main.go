@@ -71,6 +71,14 @@ func run(ctx *cli.Context) error {
 	trelloClient := trello.NewClient(conf.TrelloApiKey, conf.TrelloToken)
 	pollInterval := time.Duration(conf.PollInterval) * time.Millisecond
 	trelloEventHub := core.NewTrelloEventHub(trelloClient, pollInterval)
+	if conf.PollMaxInterval > 0 {
+		trelloEventHub.SetMaxPollInterval(time.Duration(conf.PollMaxInterval) * time.Millisecond)
+	}
+	if conf.Webhook != nil && conf.Webhook.CallbackURL != "" {
+		if err := trelloEventHub.EnableWebhook(conf.Webhook.ListenAddr, conf.Webhook.CallbackURL, conf.Webhook.Secret); err != nil {
+			return fmt.Errorf("could not enable webhooks: %w", err)
+		}
+	}
 	trelloProc, err := commands.NewTrelloCommandProcessor(configFile, trelloEventHub)
 	if err != nil {
 		log.Crit("Cout not initialize trello command.")
@@ -8,6 +8,7 @@ require (
 	github.com/inconshreveable/log15 v2.16.0+incompatible
 	github.com/lus/dgc v1.1.0
 	github.com/urfave/cli/v2 v2.25.0
+	golang.org/x/time v0.3.0
 )
 
 replace (
@@ -30,5 +31,4 @@ require (
 	golang.org/x/crypto v0.6.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/term v0.5.0 // indirect
-	golang.org/x/time v0.3.0 // indirect
 )
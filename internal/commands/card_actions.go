@@ -0,0 +1,223 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/adlio/trello"
+	"github.com/bwmarrin/discordgo"
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	cardComponentPrefix = "trello"
+
+	cardActionAssign  = "assign"
+	cardActionMove    = "move"
+	cardActionMoveTo  = "moveto"
+	cardActionDue     = "due"
+	cardActionArchive = "archive"
+)
+
+// cardComponentId returns the custom id of a card action component, the card
+// is referred by its short link so the id fits the 100 characters limit.
+func cardComponentId(action string, card *trello.Card) string {
+	return fmt.Sprintf("%s:%s:%s", cardComponentPrefix, action, card.ShortLink)
+}
+
+// cardComponents returns the action buttons attached to a card notification.
+func cardComponents(card *trello.Card) []discordgo.MessageComponent {
+	buttons := []discordgo.MessageComponent{
+		discordgo.Button{
+			Label:    "Assign me",
+			Style:    discordgo.PrimaryButton,
+			CustomID: cardComponentId(cardActionAssign, card),
+		},
+		discordgo.Button{
+			Label:    "Move to…",
+			Style:    discordgo.SecondaryButton,
+			CustomID: cardComponentId(cardActionMove, card),
+		},
+	}
+	if card.Due != nil && !card.DueComplete {
+		buttons = append(buttons, discordgo.Button{
+			Label:    "Mark due complete",
+			Style:    discordgo.SuccessButton,
+			CustomID: cardComponentId(cardActionDue, card),
+		})
+	}
+	buttons = append(buttons, discordgo.Button{
+		Label:    "Archive",
+		Style:    discordgo.DangerButton,
+		CustomID: cardComponentId(cardActionArchive, card),
+	})
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: buttons},
+	}
+}
+
+// authorizeCardAction returns the trello member linked to a discord user if
+// the member belongs to the board of the card.
+func (cp *TrelloCmdProcessor) authorizeCardAction(userId string, card *trello.Card) (*trello.Member, error) {
+	username, linked := cp.members.username(userId)
+	if !linked {
+		return nil, fmt.Errorf("your discord account is not linked to any trello member")
+	}
+	board := trello.Board{ID: card.IDBoard}
+	board.SetClient(cp.eventHub.Client)
+	members, err := board.GetMembers(trello.Arguments{"fields": "username"})
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		if strings.EqualFold(member.Username, username) {
+			return member, nil
+		}
+	}
+	return nil, fmt.Errorf("trello member @%s is not a member of this board", username)
+}
+
+// moveToComponents returns the select menu of the lists a card can be moved to.
+func (cp *TrelloCmdProcessor) moveToComponents(card *trello.Card) ([]discordgo.MessageComponent, error) {
+	board := trello.Board{ID: card.IDBoard}
+	board.SetClient(cp.eventHub.Client)
+	lists, err := board.GetLists(trello.Arguments{"filter": "open", "fields": "name"})
+	if err != nil {
+		return nil, err
+	}
+	options := []discordgo.SelectMenuOption{}
+	for _, list := range lists {
+		if list.ID == card.IDList || len(options) == maxAutocompleteChoices {
+			continue
+		}
+		options = append(options, discordgo.SelectMenuOption{
+			Label: truncateText(list.Name, 100),
+			Value: list.ID,
+		})
+	}
+	if len(options) == 0 {
+		return nil, fmt.Errorf("there is no other list on this board")
+	}
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					CustomID:    cardComponentId(cardActionMoveTo, card),
+					Placeholder: "Select a list",
+					Options:     options,
+				},
+			},
+		},
+	}, nil
+}
+
+// runCardAction executes a card action and returns the reply shown to the
+// user, along with the components of the reply if any.
+func (cp *TrelloCmdProcessor) runCardAction(interaction *discordgo.Interaction, action string, shortLink string) (string, []discordgo.MessageComponent, error) {
+	if interaction.Member == nil {
+		return "❌ Card actions are only available in servers.", nil, nil
+	}
+	card, err := cp.eventHub.Client.GetCard(shortLink, trello.Arguments{
+		"fields": "name,idBoard,idList,idMembers,due,dueComplete,closed,shortLink",
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	member, err := cp.authorizeCardAction(interaction.Member.User.ID, card)
+	if err != nil {
+		return fmt.Sprintf("❌ You can not update this card: %s.", err), nil, nil
+	}
+	switch action {
+	case cardActionAssign:
+		for _, memberId := range card.IDMembers {
+			if memberId == member.ID {
+				return fmt.Sprintf("You are already assigned to **%s**.", card.Name), nil, nil
+			}
+		}
+		if _, err := card.AddMemberID(member.ID); err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("✅ Assigned you to **%s**.", card.Name), nil, nil
+	case cardActionMove:
+		components, err := cp.moveToComponents(card)
+		if err != nil {
+			return fmt.Sprintf("❌ %s.", err), nil, nil
+		}
+		return fmt.Sprintf("Move **%s** to:", card.Name), components, nil
+	case cardActionMoveTo:
+		values := interaction.MessageComponentData().Values
+		if len(values) == 0 {
+			return "❌ No list selected.", nil, nil
+		}
+		list, err := cp.eventHub.Client.GetList(values[0], trello.Arguments{"fields": "name,idBoard"})
+		if err != nil {
+			return "", nil, err
+		}
+		if list.IDBoard != card.IDBoard {
+			return "❌ The list is not on the board of this card.", nil, nil
+		}
+		if err := card.MoveToList(list.ID); err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("✅ Moved **%s** to %s.", card.Name, list.Name), nil, nil
+	case cardActionDue:
+		if card.Due == nil {
+			return fmt.Sprintf("❌ **%s** has no due date.", card.Name), nil, nil
+		}
+		if card.DueComplete {
+			return fmt.Sprintf("The due date of **%s** is already complete.", card.Name), nil, nil
+		}
+		if err := card.Update(trello.Arguments{"dueComplete": "true"}); err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("✅ Marked the due date of **%s** complete.", card.Name), nil, nil
+	case cardActionArchive:
+		if card.Closed {
+			return fmt.Sprintf("**%s** is already archived.", card.Name), nil, nil
+		}
+		if err := card.Archive(); err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("✅ Archived **%s**.", card.Name), nil, nil
+	}
+	return "❌ Unknown card action.", nil, nil
+}
+
+func (cp *TrelloCmdProcessor) ComponentPrefix() string {
+	return cardComponentPrefix
+}
+
+// HandleComponent executes the card action buttons and list select menus of
+// the card notifications, as the trello member linked to the user.
+func (cp *TrelloCmdProcessor) HandleComponent(session *discordgo.Session, interaction *discordgo.Interaction) {
+	parts := strings.SplitN(interaction.MessageComponentData().CustomID, ":", 3)
+	if len(parts) != 3 {
+		return
+	}
+	action, shortLink := parts[1], parts[2]
+	err := session.InteractionRespond(interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Error("Could not acknowledge card action", "action", action, "card", shortLink, "error", err)
+		return
+	}
+	content, components, err := cp.runCardAction(interaction, action, shortLink)
+	if err != nil {
+		log.Error("Could not execute card action", "action", action, "card", shortLink, "error", err)
+		content = "❌ Internal error occurred, check log for more detail."
+	}
+	if components == nil {
+		components = []discordgo.MessageComponent{}
+	}
+	_, err = session.InteractionResponseEdit(interaction, &discordgo.WebhookEdit{
+		Content:    &content,
+		Components: &components,
+	})
+	if err != nil {
+		log.Error("Could not reply card action", "action", action, "card", shortLink, "error", err)
+	}
+}
@@ -0,0 +1,306 @@
+package commands
+
+import (
+	"dgtrello/internal/core"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/adlio/trello"
+	"github.com/bwmarrin/discordgo"
+	log "github.com/inconshreveable/log15"
+	"github.com/lus/dgc"
+)
+
+const (
+	messageCardTitleLen = 100
+)
+
+var (
+	regexMessageLink = regexp.MustCompile(`^https://(?:\w+\.)?discord(?:app)?\.com/channels/(\d+|@me)/(\d+)/(\d+)$`)
+)
+
+// MessageCardConfig configures the cards created from discord messages. List
+// is the name or id of the list receiving the cards, Emoji is the reaction
+// that turns a message into a card.
+type MessageCardConfig struct {
+	List  string `json:"list"`
+	Emoji string `json:"emoji"`
+}
+
+// findList returns the open list matching a name or id on the given boards.
+func (cp *TrelloCmdProcessor) findList(boardIds []string, listName string) (*trello.List, error) {
+	var found *trello.List
+	for _, boardId := range boardIds {
+		board := trello.Board{ID: boardId}
+		board.SetClient(cp.eventHub.Client)
+		lists, err := board.GetLists(trello.Arguments{"filter": "open", "fields": "name,idBoard"})
+		if err != nil {
+			return nil, err
+		}
+		for _, list := range lists {
+			if list.ID != listName && !strings.EqualFold(list.Name, listName) {
+				continue
+			}
+			if found != nil {
+				return nil, fmt.Errorf("list `%s` exists on more than one board, use the list id instead", listName)
+			}
+			found = list
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("list `%s` not found", listName)
+	}
+	return found, nil
+}
+
+// findTrelloMember resolves a discord user id to a trello member through the
+// linked members.
+func (cp *TrelloCmdProcessor) findTrelloMember(userId string) (*trello.Member, error) {
+	username, linked := cp.members.username(userId)
+	if !linked {
+		return nil, fmt.Errorf("<@%s> is not linked to any trello member", userId)
+	}
+	return cp.eventHub.Client.GetMember(username, trello.Arguments{"fields": "username,fullName"})
+}
+
+func (cp *TrelloCmdProcessor) cardCreateHandler(ctx *dgc.Ctx) {
+	channel := cp.channel(ctx.Event.ChannelID)
+	if channel == nil {
+		core.RespondText(ctx, "❌ This channel is not subscribed to any board.")
+		return
+	}
+	args := core.Arguments(ctx)
+	listName, title := args.Get(0), args.Get(1)
+	if listName == "" || title == "" {
+		core.RespondText(ctx, "❌ Invalid arguments provided.")
+		return
+	}
+	// The remaining arguments are the description and the assignee mentions
+	descWords := []string{}
+	memberIds := []string{}
+	for _, arg := range args[2:] {
+		matches := dgc.RegexUserMention.FindStringSubmatch(arg)
+		if matches == nil {
+			descWords = append(descWords, arg)
+			continue
+		}
+		member, err := cp.findTrelloMember(matches[1])
+		if err != nil {
+			core.RespondText(ctx, fmt.Sprintf("❌ %s", err))
+			return
+		}
+		memberIds = append(memberIds, member.ID)
+	}
+	list, err := cp.findList(channel.BoardIds(), listName)
+	if err != nil {
+		core.RespondText(ctx, fmt.Sprintf("❌ %s", err))
+		return
+	}
+	card := &trello.Card{
+		Name:      title,
+		Desc:      strings.Join(descWords, " "),
+		IDList:    list.ID,
+		IDMembers: memberIds,
+	}
+	if err := cp.eventHub.Client.CreateCard(card, trello.Defaults()); err != nil {
+		log.Error("Could not create card", "listId", list.ID, "error", err)
+		core.RespondText(ctx, "❌ Internal error occurred, check log for more detail.")
+		return
+	}
+	created, err := channel.fetchCard(cp.eventHub.Client, card.ID)
+	if err != nil {
+		log.Error("Could not fetch created card", "cardId", card.ID, "error", err)
+		core.RespondText(ctx, "❌ Internal error occurred, check log for more detail.")
+		return
+	}
+	msg := channel.renderCardEmbed(created, true)
+	msg.Color = eventEmbedColors[core.EventCreateCard]
+	msg.Title = truncateText(fmt.Sprintf("Created card %s in %s", created.Name, list.Name), 256)
+	core.RespondEmbed(ctx, msg)
+}
+
+// messageCardList returns the list receiving the cards created from the
+// messages of a channel, the first list of the board if none is configured.
+func (cp *TrelloCmdProcessor) messageCardList(channel *TrelloChannel) (*trello.List, error) {
+	if cp.messageCard != nil && cp.messageCard.List != "" {
+		return cp.findList(channel.BoardIds(), cp.messageCard.List)
+	}
+	boardIds := channel.BoardIds()
+	if len(boardIds) != 1 {
+		return nil, fmt.Errorf("channel subscribes more than one board, configure the list receiving message cards")
+	}
+	board := trello.Board{ID: boardIds[0]}
+	board.SetClient(cp.eventHub.Client)
+	lists, err := board.GetLists(trello.Arguments{"filter": "open", "fields": "name"})
+	if err != nil {
+		return nil, err
+	}
+	if len(lists) == 0 {
+		return nil, fmt.Errorf("board has no open list")
+	}
+	return lists[0], nil
+}
+
+// createCardFromMessage creates a card with the content, author, attachments
+// and a jump link of a discord message.
+func (cp *TrelloCmdProcessor) createCardFromMessage(channel *TrelloChannel, guildId string, message *discordgo.Message) (*trello.Card, *trello.List, error) {
+	list, err := cp.messageCardList(channel)
+	if err != nil {
+		return nil, nil, err
+	}
+	title := strings.TrimSpace(strings.SplitN(message.Content, "\n", 2)[0])
+	if title == "" {
+		title = fmt.Sprintf("Message from %s", message.Author.Username)
+	}
+	jumpLink := fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildId, message.ChannelID, message.ID)
+	card := &trello.Card{
+		Name:   truncateText(title, messageCardTitleLen),
+		Desc:   fmt.Sprintf("%s\n\n---\nPosted by **%s** on Discord: %s", message.Content, message.Author.Username, jumpLink),
+		IDList: list.ID,
+	}
+	if err := cp.eventHub.Client.CreateCard(card, trello.Defaults()); err != nil {
+		return nil, nil, err
+	}
+	for _, attachment := range message.Attachments {
+		err := card.AddURLAttachment(&trello.Attachment{Name: attachment.Filename, URL: attachment.URL})
+		if err != nil {
+			log.Error("Could not attach message attachment", "cardId", card.ID, "url", attachment.URL, "error", err)
+		}
+	}
+	cp.mtx.Lock()
+	cp.messageCards[message.ID] = card.ShortURL
+	cp.mtx.Unlock()
+	cp.saveState()
+	return card, list, nil
+}
+
+func (cp *TrelloCmdProcessor) cardMessageHandler(ctx *dgc.Ctx) {
+	channelId, messageId := ctx.Event.ChannelID, core.Arguments(ctx).Get(0)
+	if matches := regexMessageLink.FindStringSubmatch(messageId); matches != nil {
+		channelId, messageId = matches[2], matches[3]
+	}
+	channel := cp.channel(channelId)
+	if channel == nil {
+		core.RespondText(ctx, "❌ This channel is not subscribed to any board.")
+		return
+	}
+	message, err := ctx.Session.ChannelMessage(channelId, messageId)
+	if err != nil {
+		core.RespondText(ctx, "❌ Message not found.")
+		return
+	}
+	card, list, err := cp.createCardFromMessage(channel, ctx.Event.GuildID, message)
+	if err != nil {
+		log.Error("Could not create card from message", "messageId", messageId, "error", err)
+		core.RespondText(ctx, fmt.Sprintf("❌ Could not create card: %s", err))
+		return
+	}
+	core.RespondText(ctx, fmt.Sprintf("📌 Created card [%s](%s) in %s", card.Name, card.ShortURL, list.Name))
+}
+
+// onMessageReactionAdd creates a card from a message of a subscribed channel
+// when it receives the configured reaction.
+func (cp *TrelloCmdProcessor) onMessageReactionAdd(session *discordgo.Session, event *discordgo.MessageReactionAdd) {
+	if event.UserID == session.State.User.ID || event.Emoji.Name != cp.messageCard.Emoji {
+		return
+	}
+	channel := cp.channel(event.ChannelID)
+	if channel == nil {
+		return
+	}
+	// Reserve the message so concurrent reactions create a single card, an
+	// empty card url marks a card being created
+	cp.mtx.Lock()
+	_, exist := cp.messageCards[event.MessageID]
+	if !exist {
+		cp.messageCards[event.MessageID] = ""
+	}
+	cp.mtx.Unlock()
+	if exist {
+		return
+	}
+	release := func() {
+		cp.mtx.Lock()
+		delete(cp.messageCards, event.MessageID)
+		cp.mtx.Unlock()
+	}
+	message, err := session.ChannelMessage(event.ChannelID, event.MessageID)
+	if err != nil {
+		log.Error("Could not fetch reacted message", "messageId", event.MessageID, "error", err)
+		release()
+		return
+	}
+	card, list, err := cp.createCardFromMessage(channel, event.GuildID, message)
+	if err != nil {
+		log.Error("Could not create card from message", "messageId", event.MessageID, "error", err)
+		release()
+		session.ChannelMessageSendReply(event.ChannelID, fmt.Sprintf("❌ Could not create card: %s", err), message.Reference())
+		return
+	}
+	session.ChannelMessageSendReply(event.ChannelID, fmt.Sprintf("📌 Created card [%s](%s) in %s", card.Name, card.ShortURL, list.Name), message.Reference())
+}
+
+// onThreadMessage mirrors the replies posted in card threads as card comments,
+// prefixed with the linked trello username of the author.
+func (cp *TrelloCmdProcessor) onThreadMessage(session *discordgo.Session, event *discordgo.MessageCreate) {
+	if event.Author == nil || event.Author.Bot || event.GuildID == "" {
+		return
+	}
+	if cp.channel(event.ChannelID) != nil {
+		return
+	}
+	thread, err := session.State.Channel(event.ChannelID)
+	if err != nil {
+		if thread, err = session.Channel(event.ChannelID); err != nil {
+			return
+		}
+	}
+	if !thread.IsThread() {
+		return
+	}
+	channel := cp.channel(thread.ParentID)
+	if channel == nil {
+		return
+	}
+	shortLink, exist := channel.threadCard(thread)
+	if !exist {
+		return
+	}
+	name := event.Author.Username
+	if username, linked := cp.members.username(event.Author.ID); linked {
+		name = username
+	}
+	if err := channel.mirrorReply(cp.eventHub.Client, shortLink, name, event.Message); err != nil {
+		log.Error("Could not mirror thread reply", "threadId", thread.ID, "card", shortLink, "error", err)
+		session.MessageReactionAdd(event.ChannelID, event.ID, "❌")
+	}
+}
+
+func (cp *TrelloCmdProcessor) cardHandler(ctx *dgc.Ctx) {
+	core.RespondText(ctx, fmt.Sprintf("Usage: `%s`", ctx.Command.Usage))
+}
+
+func (cp *TrelloCmdProcessor) registerCardCommands(cmdRouter *dgc.Router) {
+	cmdRouter.RegisterCmd(&dgc.Command{
+		Name:        "card",
+		Description: "Manage the cards of the boards subscribed by the current channel",
+		Usage:       "card create|message ...",
+		Handler:     cp.cardHandler,
+		SubCommands: []*dgc.Command{
+			{
+				Name:        "create",
+				Description: "Create a card on a list of the boards subscribed by the current channel",
+				Usage:       "card create <list> <title> [description] [@assignees]",
+				Example:     "card create \"To Do\" \"Fix login page\" \"Crash on submit\" @alice",
+				Handler:     cp.cardCreateHandler,
+			},
+			{
+				Name:        "message",
+				Description: "Create a card from a message of the current channel",
+				Usage:       "card message <message id or link>",
+				Handler:     cp.cardMessageHandler,
+			},
+		},
+	})
+}
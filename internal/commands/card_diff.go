@@ -0,0 +1,155 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adlio/trello"
+)
+
+const (
+	// maxDiffCells bounds the size of the table used to diff descriptions,
+	// longer descriptions are reported without a diff.
+	maxDiffCells = 40000
+)
+
+// cardUpdate is what an updateCard action changed on a card.
+type cardUpdate struct {
+	changes    []string
+	descDiff   string
+	archived   bool
+	unarchived bool
+	movedTo    string
+}
+
+func decodeField(fields map[string]json.RawMessage, key string, value interface{}) bool {
+	raw, exist := fields[key]
+	if !exist {
+		return false
+	}
+	return json.Unmarshal(raw, value) == nil
+}
+
+func formatDueDate(due *time.Time) string {
+	if due == nil {
+		return "none"
+	}
+	return due.Local().Format(time.RFC1123)
+}
+
+// diffLines returns a compact diff of two texts keeping only the removed and
+// added lines, or false if the texts are too long to be diffed.
+func diffLines(before string, after string) (string, bool) {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+	if len(a)*len(b) > maxDiffCells {
+		return "", false
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	diff := ""
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff += fmt.Sprintf("- %s\n", a[i])
+			i++
+		default:
+			diff += fmt.Sprintf("+ %s\n", b[j])
+			j++
+		}
+	}
+	return diff, true
+}
+
+// diffCardUpdate compares the old values of an updateCard action, which only
+// holds the changed fields, with the new values of the card.
+func diffCardUpdate(action *trello.Action, data *actionDataExtra) *cardUpdate {
+	update := &cardUpdate{}
+	old, card := data.Old, data.Card
+	var closed bool
+	if decodeField(old, "closed", &closed) {
+		if closed {
+			update.unarchived = true
+			update.changes = append(update.changes, "restored the card from the archive")
+		} else {
+			update.archived = true
+			update.changes = append(update.changes, "archived the card")
+		}
+	}
+	if action.Data.ListBefore != nil && action.Data.ListAfter != nil {
+		update.movedTo = action.Data.ListAfter.Name
+		update.changes = append(update.changes, fmt.Sprintf("moved the card from %s to %s", action.Data.ListBefore.Name, action.Data.ListAfter.Name))
+	}
+	var oldName, newName string
+	if decodeField(old, "name", &oldName) && decodeField(card, "name", &newName) {
+		update.changes = append(update.changes, fmt.Sprintf("renamed the card from **%s** to **%s**", oldName, newName))
+	}
+	var oldDesc, newDesc string
+	if decodeField(old, "desc", &oldDesc) && decodeField(card, "desc", &newDesc) {
+		switch {
+		case oldDesc == "":
+			update.changes = append(update.changes, "added a description")
+		case newDesc == "":
+			update.changes = append(update.changes, "removed the description")
+		default:
+			update.changes = append(update.changes, "edited the description")
+		}
+		if diff, ok := diffLines(oldDesc, newDesc); ok && oldDesc != "" && newDesc != "" {
+			update.descDiff = diff
+		}
+	}
+	var oldDue, newDue *time.Time
+	if decodeField(old, "due", &oldDue) {
+		decodeField(card, "due", &newDue)
+		switch {
+		case oldDue == nil:
+			update.changes = append(update.changes, fmt.Sprintf("set the due date to %s", formatDueDate(newDue)))
+		case newDue == nil:
+			update.changes = append(update.changes, "removed the due date")
+		default:
+			update.changes = append(update.changes, fmt.Sprintf("changed the due date from %s to %s", formatDueDate(oldDue), formatDueDate(newDue)))
+		}
+	}
+	var dueComplete bool
+	if decodeField(old, "dueComplete", &dueComplete) {
+		if dueComplete {
+			update.changes = append(update.changes, "marked the due date incomplete")
+		} else {
+			update.changes = append(update.changes, "marked the due date complete")
+		}
+	}
+	var newCover string
+	if _, exist := old["idAttachmentCover"]; exist {
+		if decodeField(card, "idAttachmentCover", &newCover) && newCover != "" {
+			update.changes = append(update.changes, "changed the cover")
+		} else {
+			update.changes = append(update.changes, "removed the cover")
+		}
+	} else if _, exist := old["cover"]; exist {
+		update.changes = append(update.changes, "changed the cover")
+	}
+	if len(update.changes) == 0 {
+		update.changes = append(update.changes, "updated the card")
+	}
+	return update
+}
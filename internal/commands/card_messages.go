@@ -0,0 +1,135 @@
+package commands
+
+import (
+	"sync"
+	"time"
+
+	"github.com/adlio/trello"
+	"github.com/bwmarrin/discordgo"
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	defaultUpdateWindow = time.Hour
+)
+
+// CardMessage is the last notification of a card in a channel, the updates of
+// the card within the update window edit it instead of sending a new one.
+type CardMessage struct {
+	MessageId string    `json:"messageId"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// cardMessages tracks the live status message of the cards notified in a
+// channel, by board id and card id.
+type cardMessages struct {
+	window   time.Duration
+	messages map[string]map[string]*CardMessage
+	mtx      sync.Mutex
+}
+
+// get returns the status message of a card if it was updated within the update
+// window.
+func (m *cardMessages) get(card *trello.Card) (*CardMessage, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	msg, exist := m.messages[card.IDBoard][card.ID]
+	if !exist || time.Since(msg.UpdatedAt) > m.window {
+		return nil, false
+	}
+	return msg, true
+}
+
+func (m *cardMessages) set(card *trello.Card, messageId string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.messages[card.IDBoard] == nil {
+		m.messages[card.IDBoard] = make(map[string]*CardMessage)
+	}
+	m.messages[card.IDBoard][card.ID] = &CardMessage{MessageId: messageId, UpdatedAt: time.Now()}
+}
+
+func (m *cardMessages) remove(card *trello.Card) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.messages[card.IDBoard], card.ID)
+}
+
+func (m *cardMessages) load(boardId string, messages map[string]*CardMessage) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.messages[boardId] = make(map[string]*CardMessage)
+	for cardId, msg := range messages {
+		m.messages[boardId][cardId] = msg
+	}
+}
+
+func (m *cardMessages) removeBoard(boardId string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.messages, boardId)
+}
+
+// config returns the status messages of a board still within the update
+// window, the expired ones are dropped.
+func (m *cardMessages) config(boardId string) map[string]*CardMessage {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ret := map[string]*CardMessage{}
+	for cardId, msg := range m.messages[boardId] {
+		if time.Since(msg.UpdatedAt) > m.window {
+			delete(m.messages[boardId], cardId)
+			continue
+		}
+		ret[cardId] = msg
+	}
+	return ret
+}
+
+func isUnknownMessage(err error) bool {
+	restErr, ok := err.(*discordgo.RESTError)
+	return ok && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMessage
+}
+
+// sendCardUpdate edits the status message of the card if it was sent or edited
+// within the update window, and replies the update in the card thread so its
+// history is kept. A new notification is sent otherwise.
+func (ch *TrelloChannel) sendCardUpdate(card *trello.Card, send *discordgo.MessageSend) error {
+	last, exist := ch.messages.get(card)
+	if !exist {
+		return ch.sendCardMessage(card, send)
+	}
+	// Archived cards lose their action buttons
+	components := []discordgo.MessageComponent{}
+	if !card.Closed {
+		components = cardComponents(card)
+	}
+	_, err := ch.session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:         last.MessageId,
+		Channel:    ch.channelId,
+		Content:    &send.Content,
+		Embeds:     []*discordgo.MessageEmbed{send.Embed},
+		Components: components,
+	})
+	if err != nil {
+		if !isUnknownMessage(err) {
+			return err
+		}
+		ch.messages.remove(card)
+		return ch.sendCardMessage(card, send)
+	}
+	ch.messages.set(card, last.MessageId)
+	if threadId, exist := ch.threads.thread(card.ShortLink); exist {
+		if _, err := ch.session.ChannelMessageSend(threadId, send.Embed.Title); err != nil {
+			log.Warn("Could not reply card update in thread", "threadId", threadId, "card", card.ShortURL, "error", err)
+		}
+	}
+	return nil
+}
+
+func newCardMessages(window time.Duration) *cardMessages {
+	return &cardMessages{
+		window:   window,
+		messages: make(map[string]map[string]*CardMessage),
+	}
+}
@@ -0,0 +1,253 @@
+package commands
+
+import (
+	"dgtrello/internal/core"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adlio/trello"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	digestMaxItems     = 10
+	digestCatchUpLimit = 1000
+	// defaultDigestPeriod is the period covered by the first digest of a
+	// subscription that never sent one.
+	defaultDigestPeriod = 24 * time.Hour
+)
+
+var (
+	defaultDoneLists = []string{"Done"}
+	digestEvents     = []string{
+		core.EventCreateCard,
+		core.EventCopyCard,
+		core.EventUpdateCard,
+		core.EventCommentCard,
+		core.EventAddMemberToCard,
+		core.EventAddChecklistToCard,
+		core.EventUpdateCheckItemStateOnCard,
+		core.EventAddAttachmentToCard,
+	}
+)
+
+type DigestConfig struct {
+	Schedule  string     `json:"schedule"`
+	DoneLists []string   `json:"doneLists,omitempty"`
+	LastSent  *time.Time `json:"lastSent,omitempty"`
+}
+
+// channelDigest accumulates the actions delivered to a subscription and
+// periodically posts a summary of them.
+type channelDigest struct {
+	expr      string
+	schedule  *cronSchedule
+	doneLists []string
+	since     time.Time
+	next      time.Time
+	actions   map[string]*trello.Action
+	mtx       sync.Mutex
+}
+
+func (d *channelDigest) record(action *trello.Action) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.actions[action.ID] = action
+}
+
+func (d *channelDigest) config() *DigestConfig {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	since := d.since
+	return &DigestConfig{
+		Schedule:  d.expr,
+		DoneLists: d.doneLists,
+		LastSent:  &since,
+	}
+}
+
+func (d *channelDigest) isDoneList(list *trello.List) bool {
+	if list == nil {
+		return false
+	}
+	for _, name := range d.doneLists {
+		if strings.EqualFold(name, list.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// collect merges the recorded actions with the actions fetched from the board
+// since the last digest, so events not enabled on the subscription or missed
+// during a downtime are counted too.
+func (d *channelDigest) collect(client *trello.Client, boardId string, until time.Time) ([]*trello.Action, error) {
+	board := trello.Board{ID: boardId}
+	board.SetClient(client)
+	fetched, err := board.GetActions(trello.Arguments{
+		"filter": strings.Join(digestEvents, ","),
+		"since":  d.since.Format(time.RFC3339),
+		"limit":  fmt.Sprint(digestCatchUpLimit),
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, action := range fetched {
+		d.actions[action.ID] = action
+	}
+	actions := []*trello.Action{}
+	for _, action := range d.actions {
+		if !action.Date.Before(d.since) && action.Date.Before(until) {
+			actions = append(actions, action)
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Date.Before(actions[j].Date) })
+	return actions, nil
+}
+
+// due reports whether the digest of the period is to be sent.
+func (d *channelDigest) due(now time.Time) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return !now.Before(d.next)
+}
+
+// reset starts a new digest period.
+func (d *channelDigest) reset(now time.Time) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for id, action := range d.actions {
+		if action.Date.Before(now) {
+			delete(d.actions, id)
+		}
+	}
+	d.since = now
+	d.next = d.schedule.Next(now)
+}
+
+func renderDigestList(items []string) string {
+	if len(items) == 0 {
+		return "None"
+	}
+	text := ""
+	for idx, item := range items {
+		if idx == digestMaxItems {
+			text += fmt.Sprintf("and %d more", len(items)-digestMaxItems)
+			break
+		}
+		text += fmt.Sprintf("• %s\n", item)
+	}
+	return truncateText(text, 1024)
+}
+
+func renderCardLink(name string, shortLink string) string {
+	return fmt.Sprintf("[%s](%s/c/%s)", name, trelloUrl, shortLink)
+}
+
+func (ch *TrelloChannel) renderDigest(boardName string, d *channelDigest, actions []*trello.Action, overdueCards []*trello.Card, until time.Time) *discordgo.MessageEmbed {
+	created := []string{}
+	done := []string{}
+	activity := map[string]int{}
+	for _, action := range actions {
+		if action.MemberCreator != nil {
+			activity[action.MemberCreator.FullName]++
+		}
+		if action.Data == nil || action.Data.Card == nil {
+			continue
+		}
+		card := action.Data.Card
+		switch action.Type {
+		case core.EventCreateCard, core.EventCopyCard:
+			created = append(created, renderCardLink(card.Name, card.ShortLink))
+		case core.EventUpdateCard:
+			if !d.isDoneList(action.Data.ListBefore) && d.isDoneList(action.Data.ListAfter) {
+				done = append(done, renderCardLink(card.Name, card.ShortLink))
+			}
+		}
+	}
+	overdue := []string{}
+	for _, card := range overdueCards {
+		overdue = append(overdue, fmt.Sprintf("[%s](%s) (due %s)", card.Name, card.ShortURL, card.Due.Local().Format(time.RFC1123)))
+	}
+	members := make([]string, 0, len(activity))
+	for name := range activity {
+		members = append(members, name)
+	}
+	sort.Slice(members, func(i, j int) bool { return activity[members[i]] > activity[members[j]] })
+	activityItems := []string{}
+	for _, name := range members {
+		activityItems = append(activityItems, fmt.Sprintf("%s: %d actions", name, activity[name]))
+	}
+	return &discordgo.MessageEmbed{
+		Type:        "rich",
+		Title:       truncateText(fmt.Sprintf("📊 Digest - %s", boardName), 256),
+		Description: fmt.Sprintf("From %s to %s", d.since.Local().Format(time.RFC1123), until.Local().Format(time.RFC1123)),
+		Color:       eventEmbedColors[core.EventUpdateCard],
+		Timestamp:   until.Format(time.RFC3339),
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: fmt.Sprintf("🆕 Cards created (%d)", len(created)), Value: renderDigestList(created)},
+			{Name: fmt.Sprintf("✅ Moved to done (%d)", len(done)), Value: renderDigestList(done)},
+			{Name: fmt.Sprintf("⚠️ Overdue cards (%d)", len(overdue)), Value: renderDigestList(overdue)},
+			{Name: "👥 Member activity", Value: renderDigestList(activityItems)},
+		},
+	}
+}
+
+func (ch *TrelloChannel) sendDigest(client *trello.Client, boardId string, d *channelDigest, now time.Time) error {
+	actions, err := d.collect(client, boardId, now)
+	if err != nil {
+		return err
+	}
+	board, err := client.GetBoard(boardId, trello.Arguments{"fields": "name"})
+	if err != nil {
+		return err
+	}
+	cards, err := board.GetCards(trello.Arguments{
+		"filter": "open",
+		"fields": "name,due,dueComplete,shortUrl",
+	})
+	if err != nil {
+		return err
+	}
+	overdueCards := []*trello.Card{}
+	for _, card := range cards {
+		if card.Due != nil && !card.DueComplete && card.Due.Before(now) {
+			overdueCards = append(overdueCards, card)
+		}
+	}
+	msg := ch.renderDigest(board.Name, d, actions, overdueCards, now)
+	if _, err := ch.session.ChannelMessageSendEmbed(ch.channelId, msg); err != nil {
+		return err
+	}
+	d.reset(now)
+	return nil
+}
+
+func newChannelDigest(conf *DigestConfig) (*channelDigest, error) {
+	schedule, err := parseSchedule(conf.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	since := now.Add(-defaultDigestPeriod)
+	if conf.LastSent != nil {
+		since = *conf.LastSent
+	}
+	doneLists := conf.DoneLists
+	if len(doneLists) == 0 {
+		doneLists = defaultDoneLists
+	}
+	return &channelDigest{
+		expr:      conf.Schedule,
+		schedule:  schedule,
+		doneLists: doneLists,
+		since:     since,
+		next:      schedule.Next(now),
+		actions:   make(map[string]*trello.Action),
+	}, nil
+}
@@ -0,0 +1,265 @@
+package commands
+
+import (
+	"context"
+	"dgtrello/internal/core"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adlio/trello"
+	"github.com/bwmarrin/discordgo"
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	defaultReminderInterval = 5 * time.Minute
+	// overdueReminderWindow stops the reminder from reporting cards that were
+	// already long overdue when they are seen for the first time.
+	overdueReminderWindow = 24 * time.Hour
+)
+
+type DueReminderConfig struct {
+	Offsets  []string `json:"offsets"`
+	Overdue  bool     `json:"overdue"`
+	Interval string   `json:"interval"`
+}
+
+// ReminderStage records the last reminder sent for a card due date, stages
+// index the offsets from the farthest to the nearest, the stage after the last
+// offset is the overdue reminder.
+type ReminderStage struct {
+	Due   time.Time `json:"due"`
+	Stage int       `json:"stage"`
+}
+
+// DueReminder periodically checks the due dates of the cards on subscribed
+// boards and reminds the bound channels before the cards are due and when
+// they are overdue. Cards marked as due complete are no longer tracked. The
+// reminders sent are kept in the state so a restart does not send them again.
+type DueReminder struct {
+	cp       *TrelloCmdProcessor
+	offsets  []time.Duration
+	overdue  bool
+	interval time.Duration
+	// sent holds the last reminders sent by channel id, then card id, a
+	// board can be bound to several channels
+	sent map[string]map[string]*ReminderStage
+	// mtx guards sent, which is saved with the state
+	mtx sync.Mutex
+}
+
+// currentStage returns the reminder stage of a due date at the given time, or
+// -1 if no reminder is due yet.
+func (dr *DueReminder) currentStage(due time.Time, now time.Time) int {
+	if !now.Before(due) {
+		if dr.overdue && now.Sub(due) < overdueReminderWindow {
+			return len(dr.offsets)
+		}
+		return -1
+	}
+	stage := -1
+	for idx, offset := range dr.offsets {
+		if !now.Before(due.Add(-offset)) {
+			stage = idx
+		}
+	}
+	return stage
+}
+
+func (dr *DueReminder) renderReminder(ch *TrelloChannel, card *trello.Card, stage int) *discordgo.MessageSend {
+	msg := ch.renderCardEmbed(card, false)
+	if stage == len(dr.offsets) {
+		msg.Title = fmt.Sprintf("⚠️ %s is overdue", card.Name)
+		msg.Color = eventEmbedColors[core.EventDeleteCard]
+	} else {
+		msg.Title = fmt.Sprintf("⏰ %s is due in %s", card.Name, formatDuration(time.Until(*card.Due)))
+		msg.Color = eventEmbedColors[core.EventUpdateCard]
+	}
+	msg.Title = truncateText(msg.Title, 256)
+	mentions := []string{}
+	for _, member := range card.Members {
+		if mention, linked := ch.mentionMember(member); linked {
+			mentions = append(mentions, mention)
+		}
+	}
+	return &discordgo.MessageSend{
+		Content: strings.Join(mentions, " "),
+		Embed:   msg,
+	}
+}
+
+// boardChannels returns the channels bound to each subscribed board.
+func (dr *DueReminder) boardChannels() map[string][]*TrelloChannel {
+	dr.cp.mtx.Lock()
+	defer dr.cp.mtx.Unlock()
+	ret := map[string][]*TrelloChannel{}
+	for _, channel := range dr.cp.channels {
+		for _, boardId := range channel.BoardIds() {
+			ret[boardId] = append(ret[boardId], channel)
+		}
+	}
+	return ret
+}
+
+// isDue reports whether the reminder stage of a card is still to be sent to
+// a channel.
+func (dr *DueReminder) isDue(channelId string, card *trello.Card, stage int) bool {
+	dr.mtx.Lock()
+	defer dr.mtx.Unlock()
+	last, exist := dr.sent[channelId][card.ID]
+	return !exist || !last.Due.Equal(*card.Due) || last.Stage < stage
+}
+
+// record marks the reminder stage of a card as sent to a channel.
+func (dr *DueReminder) record(channelId string, card *trello.Card, stage int) {
+	dr.mtx.Lock()
+	defer dr.mtx.Unlock()
+	if dr.sent[channelId] == nil {
+		dr.sent[channelId] = make(map[string]*ReminderStage)
+	}
+	dr.sent[channelId][card.ID] = &ReminderStage{Due: *card.Due, Stage: stage}
+}
+
+func (dr *DueReminder) checkDueDates() {
+	now := time.Now()
+	// tracked holds the cards with a due date of each channel
+	tracked := map[string]map[string]bool{}
+	complete := true
+	reminded := false
+	for boardId, channels := range dr.boardChannels() {
+		board := trello.Board{ID: boardId}
+		board.SetClient(dr.cp.eventHub.Client)
+		cards, err := board.GetCards(trello.Arguments{
+			"filter":        "open",
+			"fields":        "name,desc,due,dueComplete,shortUrl,labels",
+			"members":       "true",
+			"member_fields": "username",
+		})
+		if err != nil {
+			log.Error("Could not fetch board cards", "boardId", boardId, "error", err)
+			complete = false
+			continue
+		}
+		for _, card := range cards {
+			if card.Due == nil || card.DueComplete {
+				continue
+			}
+			stage := dr.currentStage(*card.Due, now)
+			for _, ch := range channels {
+				if tracked[ch.channelId] == nil {
+					tracked[ch.channelId] = map[string]bool{}
+				}
+				tracked[ch.channelId][card.ID] = true
+				if !dr.isDue(ch.channelId, card, stage) {
+					continue
+				}
+				// The stage is only recorded once sent, a failed reminder
+				// is sent again by the next check
+				if stage >= 0 {
+					if _, err := ch.session.ChannelMessageSendComplex(ch.channelId, dr.renderReminder(ch, card, stage)); err != nil {
+						log.Error("Could not send due date reminder", "channelId", ch.channelId, "card", card.ShortURL, "error", err)
+						continue
+					}
+					reminded = true
+				}
+				dr.record(ch.channelId, card, stage)
+			}
+		}
+	}
+	// Forget the cards that are done, archived or no longer have a due date,
+	// unless some boards could not be fetched
+	if complete {
+		dr.mtx.Lock()
+		for channelId, cards := range dr.sent {
+			for cardId := range cards {
+				if !tracked[channelId][cardId] {
+					delete(cards, cardId)
+				}
+			}
+			if len(cards) == 0 {
+				delete(dr.sent, channelId)
+			}
+		}
+		dr.mtx.Unlock()
+	}
+	if reminded {
+		dr.cp.saveState()
+	}
+}
+
+// load restores the reminders sent before a restart.
+func (dr *DueReminder) load(sent map[string]map[string]*ReminderStage) {
+	dr.mtx.Lock()
+	defer dr.mtx.Unlock()
+	for channelId, cards := range sent {
+		dr.sent[channelId] = make(map[string]*ReminderStage, len(cards))
+		for cardId, stage := range cards {
+			dr.sent[channelId][cardId] = &ReminderStage{Due: stage.Due, Stage: stage.Stage}
+		}
+	}
+}
+
+// config returns a copy of the reminders sent to be saved.
+func (dr *DueReminder) config() map[string]map[string]*ReminderStage {
+	dr.mtx.Lock()
+	defer dr.mtx.Unlock()
+	ret := make(map[string]map[string]*ReminderStage, len(dr.sent))
+	for channelId, cards := range dr.sent {
+		ret[channelId] = make(map[string]*ReminderStage, len(cards))
+		for cardId, stage := range cards {
+			ret[channelId][cardId] = &ReminderStage{Due: stage.Due, Stage: stage.Stage}
+		}
+	}
+	return ret
+}
+
+func (dr *DueReminder) Run(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(dr.interval):
+			dr.checkDueDates()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	if d >= time.Hour {
+		return fmt.Sprintf("%dh", int(d.Round(time.Hour).Hours()))
+	}
+	return fmt.Sprintf("%dm", int(d.Round(time.Minute).Minutes()))
+}
+
+func NewDueReminder(cp *TrelloCmdProcessor, conf *DueReminderConfig) (*DueReminder, error) {
+	offsets := []time.Duration{}
+	for _, str := range conf.Offsets {
+		offset, err := time.ParseDuration(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reminder offset %s: %w", str, err)
+		}
+		offsets = append(offsets, offset)
+	}
+	// Sort from the farthest to the nearest offset
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	interval := defaultReminderInterval
+	if conf.Interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(conf.Interval); err != nil {
+			return nil, fmt.Errorf("invalid reminder interval %s: %w", conf.Interval, err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("invalid reminder interval %s: must be positive", conf.Interval)
+		}
+	}
+	return &DueReminder{
+		cp:       cp,
+		offsets:  offsets,
+		overdue:  conf.Overdue,
+		interval: interval,
+		sent:     make(map[string]map[string]*ReminderStage),
+	}, nil
+}
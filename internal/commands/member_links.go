@@ -0,0 +1,69 @@
+package commands
+
+import "sync"
+
+// memberLinks maps trello usernames to the discord user ids linked with
+// memadd. It is shared by the processor and its channels, which read it while
+// delivering events.
+type memberLinks struct {
+	links map[string]string
+	mtx   sync.Mutex
+}
+
+func (m *memberLinks) userId(username string) (string, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	userId, exist := m.links[username]
+	return userId, exist
+}
+
+// username returns the trello username linked to a discord user id.
+func (m *memberLinks) username(userId string) (string, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for username, linkedUserId := range m.links {
+		if linkedUserId == userId {
+			return username, true
+		}
+	}
+	return "", false
+}
+
+func (m *memberLinks) set(username string, userId string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.links[username] = userId
+}
+
+// remove unlinks a trello username and returns the user id it was linked to.
+func (m *memberLinks) remove(username string) (string, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	userId, exist := m.links[username]
+	delete(m.links, username)
+	return userId, exist
+}
+
+func (m *memberLinks) load(links map[string]string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.links = make(map[string]string)
+	for username, userId := range links {
+		m.links[username] = userId
+	}
+}
+
+// config returns a copy of the links to be saved.
+func (m *memberLinks) config() map[string]string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ret := make(map[string]string, len(m.links))
+	for username, userId := range m.links {
+		ret[username] = userId
+	}
+	return ret
+}
+
+func newMemberLinks() *memberLinks {
+	return &memberLinks{links: make(map[string]string)}
+}
@@ -0,0 +1,152 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	scheduleAliases = map[string]string{
+		"@hourly":  "0 * * * *",
+		"@daily":   "0 0 * * *",
+		"@weekly":  "0 0 * * 0",
+		"@monthly": "0 0 1 * *",
+	}
+)
+
+// cronSchedule is a standard 5 fields cron expression: minute, hour, day of
+// month, month and day of week. Fields support *, lists, ranges and steps.
+type cronSchedule struct {
+	minute  map[int]bool
+	hour    map[int]bool
+	dom     map[int]bool
+	month   map[int]bool
+	dow     map[int]bool
+	domStar bool
+	dowStar bool
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	ret := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step %s", part)
+			}
+			part = part[:idx]
+		}
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %s", part)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range %s", part)
+				}
+			} else if step > 1 {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("value out of range %s", part)
+		}
+		for val := start; val <= end; val += step {
+			ret[val] = true
+		}
+	}
+	return ret, nil
+}
+
+func parseSchedule(expr string) (*cronSchedule, error) {
+	if alias, ok := scheduleAliases[expr]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %s, expected 5 fields", expr)
+	}
+	var err error
+	// Like cron, a field starting with * such as */2 counts as unrestricted
+	// for the day matching rule
+	sched := &cronSchedule{
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}
+	if sched.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if sched.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if sched.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if sched.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if sched.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 are sunday
+	if sched.dow[7] {
+		sched.dow[0] = true
+	}
+	// Days that do not exist in the scheduled months, like 0 0 31 2 *, would
+	// never post anything
+	if _, ok := sched.next(time.Now()); !ok {
+		return nil, fmt.Errorf("schedule %s never matches", expr)
+	}
+	return sched, nil
+}
+
+func (sched *cronSchedule) matchDay(t time.Time) bool {
+	domMatch := sched.dom[t.Day()]
+	dowMatch := sched.dow[int(t.Weekday())]
+	// Like cron, a day matches either field when both are restricted
+	if !sched.domStar && !sched.dowStar {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// Next returns the first time matching the schedule strictly after t.
+func (sched *cronSchedule) Next(t time.Time) time.Time {
+	next, _ := sched.next(t)
+	return next
+}
+
+// next returns the first time matching the schedule strictly after t, it
+// reports false when nothing matches within 5 years, which covers the leap
+// days.
+func (sched *cronSchedule) next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !sched.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !sched.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !sched.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !sched.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+	return limit, false
+}
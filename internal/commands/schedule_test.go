@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		want  []int
+		ok    bool
+	}{
+		{"any", "*", []int{0, 1, 2, 3, 4, 5, 6, 7}, true},
+		{"step", "*/3", []int{0, 3, 6}, true},
+		{"range", "2-4", []int{2, 3, 4}, true},
+		{"range with step", "1-7/3", []int{1, 4, 7}, true},
+		{"start with step", "5/2", []int{5, 7}, true},
+		{"list", "1,6", []int{1, 6}, true},
+		{"out of range", "8", nil, false},
+		{"reversed range", "4-2", nil, false},
+		{"zero step", "*/0", nil, false},
+		{"not a number", "mon", nil, false},
+	}
+	for _, test := range tests {
+		got, err := parseCronField(test.field, 0, 7)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: parseCronField(%q) error = %v, want ok %v", test.name, test.field, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: parseCronField(%q) = %v, want %v", test.name, test.field, got, test.want)
+			continue
+		}
+		for _, val := range test.want {
+			if !got[val] {
+				t.Errorf("%s: parseCronField(%q) = %v, want %v", test.name, test.field, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// A wednesday
+	now := time.Date(2023, 3, 1, 10, 7, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		expr string
+		want time.Time
+	}{
+		{"minute step", "*/15 * * * *", time.Date(2023, 3, 1, 10, 15, 0, 0, time.UTC)},
+		{"hour range", "0 8-9 * * *", time.Date(2023, 3, 2, 8, 0, 0, 0, time.UTC)},
+		{"weekday", "0 9 * * 1", time.Date(2023, 3, 6, 9, 0, 0, 0, time.UTC)},
+		{"sunday as 7", "0 9 * * 7", time.Date(2023, 3, 5, 9, 0, 0, 0, time.UTC)},
+		{"sunday as 0", "0 9 * * 0", time.Date(2023, 3, 5, 9, 0, 0, 0, time.UTC)},
+		{"day of month or day of week", "0 0 15 * 5", time.Date(2023, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{"day of month step and day of week", "0 0 */10 * 5", time.Date(2023, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{"alias", "@monthly", time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		sched, err := parseSchedule(test.expr)
+		if err != nil {
+			t.Errorf("%s: parseSchedule(%q) failed: %v", test.name, test.expr, err)
+			continue
+		}
+		if got := sched.Next(now); !got.Equal(test.want) {
+			t.Errorf("%s: Next of %q = %v, want %v", test.name, test.expr, got, test.want)
+		}
+	}
+}
+
+func TestParseScheduleRejectsInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"0 0 31 2 *",
+		"0 0 30 2 *",
+		"0 0 31 4,6 *",
+		"* * *",
+		"61 * * * *",
+		"@yearly",
+	} {
+		if _, err := parseSchedule(expr); err == nil {
+			t.Errorf("expected parseSchedule(%q) to fail", expr)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package commands
+
+import (
+	"dgtrello/internal/core"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	stateVersion     = 1
+	defaultStateFile = "state.json"
+	// maxDeadLetters is how many dead letters are kept, the oldest are dropped
+	maxDeadLetters = 100
+)
+
+// State is the data changed while the bot runs: the subscriptions with their
+// cursors and card message mappings, the member links, the cards created from
+// messages and the due date reminders sent. It is kept apart from the config
+// file, which only holds the settings and secrets.
+type State struct {
+	Version       int                    `json:"version"`
+	Subscriptions []*TrelloChannelConfig `json:"subscriptions"`
+	Members       map[string]string      `json:"members"`
+	// MessageCards are the urls of the cards created from discord messages,
+	// by message id
+	MessageCards map[string]string `json:"messageCards,omitempty"`
+	// DueReminders are the last due date reminders sent, by channel id then
+	// card id
+	DueReminders map[string]map[string]*ReminderStage `json:"dueReminders,omitempty"`
+	// DeadLetters are only added by AddDeadLetter, Save keeps them
+	DeadLetters []*DeadLetter `json:"deadLetters,omitempty"`
+}
+
+// DeadLetter records board actions whose delivery failed permanently.
+type DeadLetter struct {
+	ChannelId string    `json:"channelId"`
+	BoardId   string    `json:"boardId"`
+	ActionIds []string  `json:"actionIds"`
+	Error     string    `json:"error"`
+	FailedAt  time.Time `json:"failedAt"`
+}
+
+// StateStore persists the state of the bot. Load returns a nil state when
+// nothing was saved yet. SaveCursor persists the cursor of a subscription
+// alone, it is called after every delivery.
+type StateStore interface {
+	Load() (*State, error)
+	Save(state *State) error
+	SaveCursor(channelId string, boardId string, lastActionId string) error
+	AddDeadLetter(letter *DeadLetter) error
+}
+
+// fileStateStore keeps the state in a json file, the last loaded or saved
+// state is kept in memory to persist the cursors.
+type fileStateStore struct {
+	path  string
+	state *State
+	mtx   sync.Mutex
+}
+
+func (s *fileStateStore) Load() (*State, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	buf, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, err
+	}
+	s.state = state
+	return state, nil
+}
+
+func (s *fileStateStore) Save(state *State) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	state.Version = stateVersion
+	// Keep the dead letters and the cursors committed since the state was built
+	if s.state != nil {
+		state.DeadLetters = s.state.DeadLetters
+		for _, sub := range state.Subscriptions {
+			for _, saved := range s.state.Subscriptions {
+				if saved.ChannelId == sub.ChannelId && saved.BoardId == sub.BoardId && !core.ActionIdBefore(saved.LastActionId, sub.LastActionId) {
+					sub.LastActionId = saved.LastActionId
+				}
+			}
+		}
+	}
+	if err := s.write(state); err != nil {
+		return err
+	}
+	s.state = state
+	return nil
+}
+
+func (s *fileStateStore) SaveCursor(channelId string, boardId string, lastActionId string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.state == nil {
+		return nil
+	}
+	for _, sub := range s.state.Subscriptions {
+		if sub.ChannelId == channelId && sub.BoardId == boardId {
+			// Cursors are committed in order, only a late one is dropped
+			if core.ActionIdBefore(lastActionId, sub.LastActionId) {
+				return nil
+			}
+			sub.LastActionId = lastActionId
+			return s.write(s.state)
+		}
+	}
+	return nil
+}
+
+func (s *fileStateStore) AddDeadLetter(letter *DeadLetter) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.state == nil {
+		return nil
+	}
+	s.state.DeadLetters = append(s.state.DeadLetters, letter)
+	if len(s.state.DeadLetters) > maxDeadLetters {
+		s.state.DeadLetters = s.state.DeadLetters[len(s.state.DeadLetters)-maxDeadLetters:]
+	}
+	return s.write(s.state)
+}
+
+func (s *fileStateStore) write(state *State) error {
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, buf)
+}
+
+// writeFileAtomic writes a temporary file next to the target then renames it
+// over the target, so a crash leaves either the previous or the new content.
+func writeFileAtomic(path string, buf []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// migrateState imports the subscriptions and member links that older versions
+// kept in the config file.
+func migrateState(config *moduleConfig) *State {
+	state := &State{
+		Version:       stateVersion,
+		Subscriptions: config.Channels,
+		Members:       config.Members,
+	}
+	if state.Subscriptions == nil {
+		state.Subscriptions = []*TrelloChannelConfig{}
+	}
+	if state.Members == nil {
+		state.Members = make(map[string]string)
+	}
+	return state
+}
+
+func NewFileStateStore(path string) StateStore {
+	return &fileStateStore{path: path}
+}
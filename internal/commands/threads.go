@@ -0,0 +1,183 @@
+package commands
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/adlio/trello"
+	"github.com/bwmarrin/discordgo"
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	threadNameLen = 100
+	// threadArchiveDuration is the inactivity in minutes after which discord
+	// archives a card thread, posting in the thread unarchives it.
+	threadArchiveDuration = 1440
+	// mirroredCommentTTL bounds how long a mirrored comment is remembered when
+	// its event never comes back, e.g. comment events are disabled.
+	mirroredCommentTTL = time.Hour
+)
+
+var (
+	regexCardShortLink = regexp.MustCompile(`trello\.com/c/(\w+)`)
+	// regexMirroredComment matches the prefix of the comments mirrored from
+	// card threads
+	regexMirroredComment = regexp.MustCompile(`^\*\*[^*]+\*\* \(Discord\): `)
+)
+
+// cardThreads maps the cards notified in a channel to the discord thread
+// started from their first notification. Replies in a thread are mirrored as
+// comments of the card, the ids of these comments are remembered so they are
+// not notified back to discord before their event is delivered.
+type cardThreads struct {
+	byCard   map[string]string
+	byThread map[string]string
+	mirrored map[string]time.Time
+	mtx      sync.Mutex
+}
+
+func (t *cardThreads) thread(shortLink string) (string, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	threadId, exist := t.byCard[shortLink]
+	return threadId, exist
+}
+
+func (t *cardThreads) card(threadId string) (string, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	shortLink, exist := t.byThread[threadId]
+	return shortLink, exist
+}
+
+// set binds a thread to a card, the notifications of a card keep going to its
+// first thread.
+func (t *cardThreads) set(shortLink string, threadId string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.byThread[threadId] = shortLink
+	if _, exist := t.byCard[shortLink]; !exist {
+		t.byCard[shortLink] = threadId
+	}
+}
+
+func (t *cardThreads) remove(shortLink string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if threadId, exist := t.byCard[shortLink]; exist {
+		delete(t.byThread, threadId)
+		delete(t.byCard, shortLink)
+	}
+}
+
+func (t *cardThreads) isMirroredComment(actionId string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	// Kept until it expires, a failed delivery may check it again
+	_, exist := t.mirrored[actionId]
+	return exist
+}
+
+// isOwnComment reports the comments mirrored from card threads, recognized
+// by their prefix and author: the member of the bot token. It covers the
+// comments delivered after a restart or after the mirrored ids expired.
+func (ch *TrelloChannel) isOwnComment(action *trello.Action) bool {
+	return ch.botMemberId != "" && action.IDMemberCreator == ch.botMemberId && regexMirroredComment.MatchString(action.Data.Text)
+}
+
+func isUnknownChannel(err error) bool {
+	restErr, ok := err.(*discordgo.RESTError)
+	return ok && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownChannel
+}
+
+// sendCardMessage sends a card notification with the card action buttons to
+// the channel and starts the card thread from it if the card has none yet.
+func (ch *TrelloChannel) sendCardMessage(card *trello.Card, send *discordgo.MessageSend) error {
+	if !card.Closed {
+		send.Components = cardComponents(card)
+	}
+	msg, err := ch.session.ChannelMessageSendComplex(ch.channelId, send)
+	if err != nil {
+		return err
+	}
+	ch.messages.set(card, msg.ID)
+	if _, exist := ch.threads.thread(card.ShortLink); exist {
+		return nil
+	}
+	thread, err := ch.session.MessageThreadStart(ch.channelId, msg.ID, truncateText(card.Name, threadNameLen), threadArchiveDuration)
+	if err != nil {
+		log.Warn("Could not start card thread", "channelId", ch.channelId, "card", card.ShortURL, "error", err)
+		return nil
+	}
+	ch.threads.set(card.ShortLink, thread.ID)
+	return nil
+}
+
+// sendCardComment posts a comment notification in the card thread, or to the
+// channel if the card has no thread or its thread was deleted.
+func (ch *TrelloChannel) sendCardComment(card *trello.Card, send *discordgo.MessageSend) error {
+	if threadId, exist := ch.threads.thread(card.ShortLink); exist {
+		_, err := ch.session.ChannelMessageSendComplex(threadId, send)
+		if err == nil || !isUnknownChannel(err) {
+			return err
+		}
+		ch.threads.remove(card.ShortLink)
+	}
+	return ch.sendCardMessage(card, send)
+}
+
+// threadCard returns the short link of the card discussed in a thread of the
+// channel. Threads started before a restart are recovered from the card link
+// of their starter message, which shares its id with the thread.
+func (ch *TrelloChannel) threadCard(thread *discordgo.Channel) (string, bool) {
+	if shortLink, exist := ch.threads.card(thread.ID); exist {
+		return shortLink, true
+	}
+	msg, err := ch.session.ChannelMessage(ch.channelId, thread.ID)
+	if err != nil || msg.Author == nil || msg.Author.ID != ch.session.State.User.ID || len(msg.Embeds) == 0 {
+		return "", false
+	}
+	matches := regexCardShortLink.FindStringSubmatch(msg.Embeds[0].URL)
+	if matches == nil {
+		return "", false
+	}
+	ch.threads.set(matches[1], thread.ID)
+	return matches[1], true
+}
+
+// mirrorReply posts a reply of a card thread as a comment of the card.
+func (ch *TrelloChannel) mirrorReply(client *trello.Client, shortLink string, authorName string, msg *discordgo.Message) error {
+	text := fmt.Sprintf("**%s** (Discord): %s", authorName, msg.Content)
+	for _, attachment := range msg.Attachments {
+		text += "\n" + attachment.URL
+	}
+	card := &trello.Card{ID: shortLink}
+	card.SetClient(client)
+	// Hold the lock until the comment is recorded, the webhook may deliver the
+	// comment event before AddComment returns
+	ch.threads.mtx.Lock()
+	defer ch.threads.mtx.Unlock()
+	action, err := card.AddComment(text)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for actionId, at := range ch.threads.mirrored {
+		if now.Sub(at) > mirroredCommentTTL {
+			delete(ch.threads.mirrored, actionId)
+		}
+	}
+	ch.threads.mirrored[action.ID] = now
+	return nil
+}
+
+func newCardThreads() *cardThreads {
+	return &cardThreads{
+		byCard:   make(map[string]string),
+		byThread: make(map[string]string),
+		mirrored: make(map[string]time.Time),
+	}
+}
@@ -2,7 +2,11 @@ package commands
 
 import (
 	"dgtrello/internal/core"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/adlio/trello"
@@ -12,47 +16,196 @@ import (
 
 var (
 	eventEmbedColors = map[string]int{
-		core.EventCreateCard:       0x27ae60, // green
-		core.EventCopyCard:         0x27ae60, // cyan
-		core.EventCommentCard:      0x7f8c8d, // gray
-		core.EventDeleteCard:       0xe74c3c, // red
-		core.EventUpdateCard:       0x2980b9, // carrot
-		core.EventAddMemberToBoard: 0xf39c12, // orange
-		core.EventAddMemberToCard:  0xf39c12, // orange
+		core.EventCreateCard:                 0x27ae60, // green
+		core.EventCopyCard:                   0x27ae60, // cyan
+		core.EventCommentCard:                0x7f8c8d, // gray
+		core.EventDeleteCard:                 0xe74c3c, // red
+		core.EventUpdateCard:                 0x2980b9, // carrot
+		core.EventAddMemberToBoard:           0xf39c12, // orange
+		core.EventAddMemberToCard:            0xf39c12, // orange
+		core.EventRemoveMemberFromBoard:      0xe67e22, // carrot
+		core.EventRemoveMemberFromCard:       0xe67e22, // carrot
+		core.EventAddChecklistToCard:         0x16a085, // teal
+		core.EventCreateCheckItem:            0x16a085, // teal
+		core.EventDeleteCheckItem:            0x7f8c8d, // gray
+		core.EventUpdateCheckItemStateOnCard: 0x27ae60, // green
+		core.EventAddLabelToCard:             0x8e44ad, // purple
+		core.EventRemoveLabelFromCard:        0x7f8c8d, // gray
+		core.EventAddAttachmentToCard:        0x34495e, // navy
+		core.EventDeleteAttachmentFromCard:   0x7f8c8d, // gray
+	}
+	// labelColorEvents are the events whose embed takes the color of the card's
+	// primary label, the color of other events carries more meaning.
+	labelColorEvents = map[string]bool{
+		core.EventCommentCard: true,
+		core.EventUpdateCard:  true,
 	}
 )
 
+// actionDataExtra holds the action data fields not decoded by trello.ActionData.
+type actionDataExtra struct {
+	Label      *trello.Label      `json:"label,omitempty"`
+	Attachment *trello.Attachment `json:"attachment,omitempty"`
+	// Old holds the previous values of the fields changed by an updateCard
+	// action, Card their new values
+	Old  map[string]json.RawMessage `json:"old,omitempty"`
+	Card map[string]json.RawMessage `json:"card,omitempty"`
+}
+
 type TrelloChannelConfig struct {
-	ChannelId     string   `json:"channelId"`
-	BoardId       string   `json:"boardId"`
-	EnabledEvents []string `json:"enabledEvents"`
-	LastActionId  string   `json:"lastActionId"`
+	ChannelId     string        `json:"channelId"`
+	BoardId       string        `json:"boardId"`
+	EnabledEvents []string      `json:"enabledEvents"`
+	LastActionId  string        `json:"lastActionId"`
+	Digest        *DigestConfig `json:"digest,omitempty"`
+	// CardMessages are the live status messages of the cards, by card id
+	CardMessages map[string]*CardMessage `json:"cardMessages,omitempty"`
 }
 
 type TrelloChannel struct {
 	channelId string
-	members   map[string]string
+	members   *memberLinks
 	session   *discordgo.Session
-	listener  *core.TrelloEventListener
+	// listeners and digests are guarded by mtx, they change with the
+	// subscriptions while events are delivered
+	listeners map[string]*core.TrelloEventListener
+	digests   map[string]*channelDigest
+	mtx       sync.Mutex
+	threads   *cardThreads
+	messages  *cardMessages
+	coalescer *core.EventCoalescer
+	queue     *core.DeliveryQueue
+	store     StateStore
+	// botMemberId is the trello member of the bot token, the author of the
+	// comments mirrored from the card threads
+	botMemberId string
+	// cursors are the last action delivered for each board
+	cursors   map[string]string
+	cursorMtx sync.Mutex
+}
+
+func (ch *TrelloChannel) BoardIds() []string {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	ret := make([]string, 0, len(ch.listeners))
+	for boardId := range ch.listeners {
+		ret = append(ret, boardId)
+	}
+	return ret
+}
+
+func (ch *TrelloChannel) GetListener(boardId string) *core.TrelloEventListener {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	return ch.listeners[boardId]
 }
 
-func (ch *TrelloChannel) BoardId() string {
-	return ch.listener.IdModel
+func (ch *TrelloChannel) digest(boardId string) (*channelDigest, bool) {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	digest, exist := ch.digests[boardId]
+	return digest, exist
 }
 
 func (ch *TrelloChannel) ChannelId() string {
 	return ch.channelId
 }
 
+func (ch *TrelloChannel) cursor(boardId string) string {
+	ch.cursorMtx.Lock()
+	defer ch.cursorMtx.Unlock()
+	return ch.cursors[boardId]
+}
+
+// commitCursor persists the cursor of a subscription right after its actions
+// are delivered, so a restart only replays the actions being delivered.
+func (ch *TrelloChannel) commitCursor(ctx *core.TrelloEventCtx, lastActionId string) {
+	ch.cursorMtx.Lock()
+	ch.cursors[ctx.IdModel] = lastActionId
+	ch.cursorMtx.Unlock()
+	if err := ch.store.SaveCursor(ch.channelId, ctx.IdModel, lastActionId); err != nil {
+		log.Error("Could not save cursor", "channelId", ch.channelId, "boardId", ctx.IdModel, "error", err)
+	}
+}
+
+// mentionMember returns the mention of the discord user linked to a trello
+// member, or the trello username if the member is not linked.
+func (ch *TrelloChannel) mentionMember(member *trello.Member) (string, bool) {
+	if userId, exist := ch.members.userId(member.Username); exist {
+		return fmt.Sprintf("<@%s>", userId), true
+	}
+	return fmt.Sprintf("@%s", member.Username), false
+}
+
 func (ch *TrelloChannel) fetchCard(client *trello.Client, cardId string) (*trello.Card, error) {
 	return client.GetCard(cardId, trello.Arguments{
 		"members":         "true",
 		"member_fields":   "username",
 		"checklists":      "all",
 		"checkItemStates": "false",
+		"attachments":     "true",
 	})
 }
 
+func (ch *TrelloChannel) fetchActionData(client *trello.Client, actionId string) (*actionDataExtra, error) {
+	action := struct {
+		Data *actionDataExtra `json:"data"`
+	}{}
+	err := client.Get(fmt.Sprintf("actions/%s", actionId), trello.Arguments{"fields": "data"}, &action)
+	if err != nil {
+		return nil, err
+	}
+	if action.Data == nil {
+		return &actionDataExtra{}, nil
+	}
+	return action.Data, nil
+}
+
+// eventColor returns the embed color of an event on a card.
+func (ch *TrelloChannel) eventColor(eventType string, card *trello.Card) int {
+	if labelColorEvents[eventType] {
+		for _, label := range card.Labels {
+			if color, ok := labelColor(label.Color); ok {
+				return color
+			}
+		}
+	}
+	return eventEmbedColors[eventType]
+}
+
+func (ch *TrelloChannel) renderLabels(labels []*trello.Label) string {
+	labelsText := ""
+	for _, label := range labels {
+		name := label.Name
+		if name == "" {
+			name = label.Color
+		}
+		labelsText += fmt.Sprintf("`%s` ", name)
+	}
+	return labelsText
+}
+
+func (ch *TrelloChannel) renderChecklistField(checklist *trello.Checklist) *discordgo.MessageEmbedField {
+	itemsMsg := ""
+	completed := 0
+	for _, item := range checklist.CheckItems {
+		if item.State == "complete" {
+			itemsMsg += fmt.Sprintf("✅ %s\n", item.Name)
+			completed++
+		} else {
+			itemsMsg += fmt.Sprintf("⭕️ %s\n", item.Name)
+		}
+	}
+	if len(checklist.CheckItems) == 0 {
+		itemsMsg = "No items yet"
+	}
+	return &discordgo.MessageEmbedField{
+		Name:   fmt.Sprintf("📝 %s (%d/%d)", checklist.Name, completed, len(checklist.CheckItems)),
+		Value:  truncateText(itemsMsg, 1024),
+		Inline: false,
+	}
+}
+
 func (ch *TrelloChannel) renderCardEmbed(card *trello.Card, showCheckList bool) *discordgo.MessageEmbed {
 	// Initialize embed message with name and description field
 	fields := []*discordgo.MessageEmbedField{
@@ -65,19 +218,7 @@ func (ch *TrelloChannel) renderCardEmbed(card *trello.Card, showCheckList bool)
 	// Add check lists field
 	if showCheckList && len(card.Checklists) > 0 {
 		for _, checklist := range card.Checklists {
-			itemsMsg := ""
-			for _, item := range checklist.CheckItems {
-				if item.State == "complete" {
-					itemsMsg += fmt.Sprintf("✅ %s\n", item.Name)
-				} else {
-					itemsMsg += fmt.Sprintf("⭕️ %s\n", item.Name)
-				}
-			}
-			fields = append(fields, &discordgo.MessageEmbedField{
-				Name:   "📝 " + checklist.Name,
-				Value:  itemsMsg,
-				Inline: false,
-			})
+			fields = append(fields, ch.renderChecklistField(checklist))
 		}
 	}
 	// Add assignees filed
@@ -85,11 +226,8 @@ func (ch *TrelloChannel) renderCardEmbed(card *trello.Card, showCheckList bool)
 	if len(card.Members) > 0 {
 		membersText = ""
 		for _, member := range card.Members {
-			if userId, exist := ch.members[member.Username]; exist {
-				membersText += fmt.Sprintf("<@%s>", userId)
-			} else {
-				membersText += fmt.Sprintf("@%s ", member.Username)
-			}
+			mention, _ := ch.mentionMember(member)
+			membersText += mention + " "
 		}
 	}
 	fields = append(fields, &discordgo.MessageEmbedField{
@@ -97,6 +235,14 @@ func (ch *TrelloChannel) renderCardEmbed(card *trello.Card, showCheckList bool)
 		Value:  membersText,
 		Inline: false,
 	})
+	// Add labels field
+	if len(card.Labels) > 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   "🏷️ Labels",
+			Value:  truncateText(ch.renderLabels(card.Labels), 1024),
+			Inline: false,
+		})
+	}
 	// Add due date field
 	if card.Due != nil {
 		fields = append(fields, &discordgo.MessageEmbedField{
@@ -105,36 +251,87 @@ func (ch *TrelloChannel) renderCardEmbed(card *trello.Card, showCheckList bool)
 			Inline: false,
 		})
 	}
-	return &discordgo.MessageEmbed{
+	msg := &discordgo.MessageEmbed{
 		URL:       card.ShortURL,
 		Type:      "rich",
 		Title:     card.Name,
 		Timestamp: time.Now().Format(time.RFC3339),
-		Fields:    fields,
 	}
+	// Show the cover as image, or the first image attachment as thumbnail, and
+	// list the other attachments as links
+	linksText := ""
+	for _, attachment := range card.Attachments {
+		if !isImageAttachment(attachment) {
+			linksText += fmt.Sprintf("[%s](%s)\n", attachment.Name, attachment.URL)
+		} else if attachment.ID == card.IDAttachmentCover {
+			msg.Image = &discordgo.MessageEmbedImage{URL: attachment.URL}
+		} else if msg.Thumbnail == nil {
+			msg.Thumbnail = &discordgo.MessageEmbedThumbnail{URL: attachment.URL}
+		}
+	}
+	if len(linksText) > 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   "📎 Attachments",
+			Value:  truncateText(linksText, 1024),
+			Inline: false,
+		})
+	}
+	msg.Fields = fields
+	return msg
 }
 
 func (ch *TrelloChannel) handleEventUpdateCard(ctx *core.TrelloEventCtx, action *trello.Action) error {
+	data, err := ch.fetchActionData(ctx.Client, action.ID)
+	if err != nil {
+		return err
+	}
 	card, err := ch.fetchCard(ctx.Client, action.Data.Card.ID)
 	if err != nil {
 		return err
 	}
+	update := diffCardUpdate(action, data)
 	msg := ch.renderCardEmbed(card, true)
-	msg.Color = eventEmbedColors[action.Type]
-	msg.Title = fmt.Sprintf("%s update a card", action.MemberCreator.FullName)
-	if card.Closed {
+	msg.Color = ch.eventColor(action.Type, card)
+	switch {
+	case update.unarchived:
+		msg.Title = fmt.Sprintf("%s restored a card from the archive", action.MemberCreator.FullName)
+		msg.Color = eventEmbedColors[core.EventCreateCard]
+	case update.archived:
 		msg.Title = fmt.Sprintf("%s archived a card", action.MemberCreator.FullName)
 		msg.Color = eventEmbedColors[core.EventDeleteCard]
-	} else if action.Data.ListBefore != nil && action.Data.ListAfter != nil {
-		msg.Title = fmt.Sprintf(" %s moved a card to %s", action.MemberCreator.FullName, action.Data.ListAfter.Name)
-	} else if action.Data.Old.Pos != 0 {
-		// ignore card position update
-		return nil
+	case update.movedTo != "":
+		msg.Title = fmt.Sprintf("%s moved a card to %s", action.MemberCreator.FullName, update.movedTo)
+	default:
+		msg.Title = fmt.Sprintf("%s updated a card", action.MemberCreator.FullName)
 	}
 	// Add board name
-	msg.Title = fmt.Sprintf("%s - %s", msg.Title, action.Data.Board.Name)
-	_, err = ch.session.ChannelMessageSendEmbed(ch.channelId, msg)
-	return err
+	msg.Title = truncateText(fmt.Sprintf("%s - %s", msg.Title, action.Data.Board.Name), 256)
+	// Insert what changed right after the card description
+	changesText := ""
+	for _, change := range update.changes {
+		changesText += fmt.Sprintf("• %s\n", change)
+	}
+	fields := []*discordgo.MessageEmbedField{
+		msg.Fields[0],
+		{
+			Name:   "📝 Changes",
+			Value:  truncateText(changesText, 1024),
+			Inline: false,
+		},
+	}
+	if update.descDiff != "" {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   "📄 Description changes",
+			Value:  fmt.Sprintf("```diff\n%s```", truncateText(update.descDiff, 1000)),
+			Inline: false,
+		})
+	}
+	msg.Fields = append(fields, msg.Fields[1:]...)
+	// Restored cards get a notification of their own
+	if update.unarchived {
+		return ch.sendCardMessage(card, &discordgo.MessageSend{Embed: msg})
+	}
+	return ch.sendCardUpdate(card, &discordgo.MessageSend{Embed: msg})
 }
 
 func (ch *TrelloChannel) handleEventCreateCard(ctx *core.TrelloEventCtx, action *trello.Action) error {
@@ -143,22 +340,51 @@ func (ch *TrelloChannel) handleEventCreateCard(ctx *core.TrelloEventCtx, action
 		return err
 	}
 	msg := ch.renderCardEmbed(card, true)
-	msg.Color = eventEmbedColors[action.Type]
+	msg.Color = ch.eventColor(action.Type, card)
 	msg.Title = fmt.Sprintf("%s created a new card", action.MemberCreator.FullName)
-	_, err = ch.session.ChannelMessageSendEmbed(ch.channelId, msg)
-	return err
+	return ch.sendCardMessage(card, &discordgo.MessageSend{Embed: msg})
 }
 
-func (ch *TrelloChannel) handleEventDeleteCard(ctx *core.TrelloEventCtx, action *trello.Action) error {
-	card, err := ch.fetchCard(ctx.Client, action.Data.Card.ID)
-	if err != nil {
+// renderDeletedCard renders a card that can no longer be fetched from the data
+// of its actions, deleteCard actions only carry the card short id.
+func (ch *TrelloChannel) renderDeletedCard(actions []*trello.Action) *discordgo.MessageEmbed {
+	data := actions[0].Data
+	name := fmt.Sprintf("Card #%d", data.Card.IDShort)
+	for _, action := range actions {
+		if action.Data.Card != nil && action.Data.Card.Name != "" {
+			name = action.Data.Card.Name
+		}
+	}
+	value := "The card was deleted"
+	if data.List != nil && data.List.Name != "" {
+		value = fmt.Sprintf("The card was deleted from %s", data.List.Name)
+	}
+	return &discordgo.MessageEmbed{
+		Type:      "rich",
+		Title:     name,
+		Color:     eventEmbedColors[core.EventDeleteCard],
+		Timestamp: time.Now().Format(time.RFC3339),
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: truncateText(fmt.Sprintf("🪧 %s", name), 256), Value: value},
+		},
+	}
+}
+
+// sendDeletedCard notifies the actions on a deleted card, without buttons nor
+// thread, and forgets the status message of the card.
+func (ch *TrelloChannel) sendDeletedCard(ctx *core.TrelloEventCtx, cardId string, send *discordgo.MessageSend) error {
+	if _, err := ch.session.ChannelMessageSendComplex(ch.channelId, send); err != nil {
 		return err
 	}
-	msg := ch.renderCardEmbed(card, true)
-	msg.Color = eventEmbedColors[action.Type]
+	ch.messages.remove(&trello.Card{ID: cardId, IDBoard: ctx.IdModel})
+	return nil
+}
+
+func (ch *TrelloChannel) handleEventDeleteCard(ctx *core.TrelloEventCtx, action *trello.Action) error {
+	// The card is gone, fetching it would fail
+	msg := ch.renderDeletedCard([]*trello.Action{action})
 	msg.Title = fmt.Sprintf("%s deleted a card", action.MemberCreator.FullName)
-	_, err = ch.session.ChannelMessageSendEmbed(ch.channelId, msg)
-	return err
+	return ch.sendDeletedCard(ctx, action.Data.Card.ID, &discordgo.MessageSend{Embed: msg})
 }
 
 func (ch *TrelloChannel) handleEventCommentCard(ctx *core.TrelloEventCtx, action *trello.Action) error {
@@ -167,33 +393,402 @@ func (ch *TrelloChannel) handleEventCommentCard(ctx *core.TrelloEventCtx, action
 		return err
 	}
 	msg := ch.renderCardEmbed(card, false)
-	msg.Color = eventEmbedColors[action.Type]
+	msg.Color = ch.eventColor(action.Type, card)
 	msg.Title = fmt.Sprintf("%s commented on a card", action.MemberCreator.FullName)
 	msg.Fields = append(msg.Fields, &discordgo.MessageEmbedField{
 		Name:   fmt.Sprintf("💬 %s commented", action.MemberCreator.FullName),
 		Value:  truncateText(action.Data.Text, 1024), // maxLen 1024
 		Inline: false,
 	})
-	_, err = ch.session.ChannelMessageSendEmbed(ch.channelId, msg)
+	return ch.sendCardComment(card, &discordgo.MessageSend{Embed: msg})
+}
+
+func (ch *TrelloChannel) handleEventChecklist(ctx *core.TrelloEventCtx, action *trello.Action) error {
+	if action.Data.Checklist == nil {
+		return nil
+	}
+	card, err := ch.fetchCard(ctx.Client, action.Data.Card.ID)
+	if err != nil {
+		return err
+	}
+	msg := ch.renderCardEmbed(card, false)
+	msg.Color = ch.eventColor(action.Type, card)
+	itemName := ""
+	if action.Data.CheckItem != nil {
+		itemName = action.Data.CheckItem.Name
+	}
+	switch action.Type {
+	case core.EventAddChecklistToCard:
+		msg.Title = fmt.Sprintf("%s added checklist %s", action.MemberCreator.FullName, action.Data.Checklist.Name)
+	case core.EventCreateCheckItem:
+		msg.Title = fmt.Sprintf("%s added %s to %s", action.MemberCreator.FullName, itemName, action.Data.Checklist.Name)
+	case core.EventDeleteCheckItem:
+		msg.Title = fmt.Sprintf("%s deleted %s from %s", action.MemberCreator.FullName, itemName, action.Data.Checklist.Name)
+	case core.EventUpdateCheckItemStateOnCard:
+		if action.Data.CheckItem != nil && action.Data.CheckItem.State == "complete" {
+			msg.Title = fmt.Sprintf("%s completed %s", action.MemberCreator.FullName, itemName)
+		} else {
+			msg.Title = fmt.Sprintf("%s marked %s incomplete", action.MemberCreator.FullName, itemName)
+			msg.Color = eventEmbedColors[core.EventDeleteCheckItem]
+		}
+	}
+	msg.Title = truncateText(msg.Title, 256)
+	for _, checklist := range card.Checklists {
+		if checklist.ID == action.Data.Checklist.ID {
+			// Insert the checklist progress right after the card description
+			fields := append([]*discordgo.MessageEmbedField{msg.Fields[0], ch.renderChecklistField(checklist)}, msg.Fields[1:]...)
+			msg.Fields = fields
+			break
+		}
+	}
+	return ch.sendCardMessage(card, &discordgo.MessageSend{Embed: msg})
+}
+
+func (ch *TrelloChannel) handleEventLabelCard(ctx *core.TrelloEventCtx, action *trello.Action) error {
+	data, err := ch.fetchActionData(ctx.Client, action.ID)
+	if err != nil {
+		return err
+	}
+	if data.Label == nil {
+		return nil
+	}
+	card, err := ch.fetchCard(ctx.Client, action.Data.Card.ID)
+	if err != nil {
+		return err
+	}
+	msg := ch.renderCardEmbed(card, false)
+	msg.Color = eventEmbedColors[action.Type]
+	labelName := ch.renderLabels([]*trello.Label{data.Label})
+	if action.Type == core.EventAddLabelToCard {
+		msg.Title = fmt.Sprintf("%s added label %s", action.MemberCreator.FullName, labelName)
+		if color, ok := labelColor(data.Label.Color); ok {
+			msg.Color = color
+		}
+	} else {
+		msg.Title = fmt.Sprintf("%s removed label %s", action.MemberCreator.FullName, labelName)
+	}
+	msg.Title = truncateText(msg.Title, 256)
+	return ch.sendCardMessage(card, &discordgo.MessageSend{Embed: msg})
+}
+
+func (ch *TrelloChannel) handleEventAttachmentCard(ctx *core.TrelloEventCtx, action *trello.Action) error {
+	data, err := ch.fetchActionData(ctx.Client, action.ID)
+	if err != nil {
+		return err
+	}
+	if data.Attachment == nil {
+		return nil
+	}
+	card, err := ch.fetchCard(ctx.Client, action.Data.Card.ID)
+	if err != nil {
+		return err
+	}
+	msg := ch.renderCardEmbed(card, false)
+	msg.Color = ch.eventColor(action.Type, card)
+	if action.Type == core.EventAddAttachmentToCard {
+		msg.Title = fmt.Sprintf("%s attached %s to a card", action.MemberCreator.FullName, data.Attachment.Name)
+		if isImageAttachment(data.Attachment) {
+			msg.Image = &discordgo.MessageEmbedImage{URL: data.Attachment.URL}
+		}
+	} else {
+		msg.Title = fmt.Sprintf("%s removed attachment %s from a card", action.MemberCreator.FullName, data.Attachment.Name)
+	}
+	msg.Title = truncateText(msg.Title, 256)
+	return ch.sendCardMessage(card, &discordgo.MessageSend{Embed: msg})
+}
+
+// memberMessage returns the embed along with the mention of the linked discord
+// user so the member gets pinged, mentions inside embeds do not notify.
+func (ch *TrelloChannel) memberMessage(member *trello.Member, msg *discordgo.MessageEmbed) *discordgo.MessageSend {
+	content := ""
+	if mention, linked := ch.mentionMember(member); linked {
+		content = mention
+	}
+	return &discordgo.MessageSend{
+		Content: content,
+		Embed:   msg,
+	}
+}
+
+func (ch *TrelloChannel) handleEventMemberCard(ctx *core.TrelloEventCtx, action *trello.Action) error {
+	if action.Member == nil {
+		return nil
+	}
+	card, err := ch.fetchCard(ctx.Client, action.Data.Card.ID)
+	if err != nil {
+		return err
+	}
+	msg := ch.renderCardEmbed(card, false)
+	msg.Color = ch.eventColor(action.Type, card)
+	mention, _ := ch.mentionMember(action.Member)
+	switch {
+	case action.Type == core.EventAddMemberToCard && action.Member.ID == action.IDMemberCreator:
+		msg.Title = fmt.Sprintf("%s joined a card", action.MemberCreator.FullName)
+	case action.Type == core.EventAddMemberToCard:
+		msg.Title = fmt.Sprintf("%s assigned %s to a card", action.MemberCreator.FullName, action.Member.FullName)
+		msg.Description = fmt.Sprintf("%s has been assigned to this card.", mention)
+	case action.Member.ID == action.IDMemberCreator:
+		msg.Title = fmt.Sprintf("%s left a card", action.MemberCreator.FullName)
+	default:
+		msg.Title = fmt.Sprintf("%s removed %s from a card", action.MemberCreator.FullName, action.Member.FullName)
+		msg.Description = fmt.Sprintf("%s is no longer assigned to this card.", mention)
+	}
+	if action.Type == core.EventRemoveMemberFromCard {
+		return ch.sendCardMessage(card, &discordgo.MessageSend{Embed: msg})
+	}
+	return ch.sendCardMessage(card, ch.memberMessage(action.Member, msg))
+}
+
+func (ch *TrelloChannel) handleEventMemberBoard(ctx *core.TrelloEventCtx, action *trello.Action) error {
+	if action.Member == nil {
+		return nil
+	}
+	mention, _ := ch.mentionMember(action.Member)
+	msg := &discordgo.MessageEmbed{
+		Type:      "rich",
+		Color:     eventEmbedColors[action.Type],
+		Timestamp: time.Now().Format(time.RFC3339),
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   "👤 Member",
+				Value:  fmt.Sprintf("%s (%s)", action.Member.FullName, mention),
+				Inline: false,
+			},
+		},
+	}
+	if action.Type == core.EventAddMemberToBoard {
+		msg.Title = fmt.Sprintf("%s added %s to the board", action.MemberCreator.FullName, action.Member.FullName)
+	} else {
+		msg.Title = fmt.Sprintf("%s removed %s from the board", action.MemberCreator.FullName, action.Member.FullName)
+	}
+	// Add board name
+	msg.Title = fmt.Sprintf("%s - %s", msg.Title, action.Data.Board.Name)
+	if action.Type == core.EventRemoveMemberFromBoard {
+		_, err := ch.session.ChannelMessageSendEmbed(ch.channelId, msg)
+		return err
+	}
+	_, err := ch.session.ChannelMessageSendComplex(ch.channelId, ch.memberMessage(action.Member, msg))
 	return err
 }
 
-func (ch *TrelloChannel) OnTrelloEvent(ctx *core.TrelloEventCtx, action *trello.Action) {
-	var err error
+// describeAction returns a one line summary of an action on a card.
+func (ch *TrelloChannel) describeAction(ctx *core.TrelloEventCtx, action *trello.Action) string {
+	itemName := ""
+	if action.Data.CheckItem != nil {
+		itemName = action.Data.CheckItem.Name
+	}
 	switch action.Type {
 	case core.EventCreateCard:
-		err = ch.handleEventCreateCard(ctx, action)
+		return "created the card"
+	case core.EventCopyCard:
+		return "copied the card"
+	case core.EventDeleteCard:
+		return "deleted the card"
 	case core.EventUpdateCard:
-		err = ch.handleEventUpdateCard(ctx, action)
+		data, err := ch.fetchActionData(ctx.Client, action.ID)
+		if err != nil {
+			log.Warn("Could not fetch action data", "actionId", action.ID, "error", err)
+			break
+		}
+		return strings.Join(diffCardUpdate(action, data).changes, ", ")
+	case core.EventCommentCard:
+		return fmt.Sprintf("commented: %s", truncateText(action.Data.Text, 200))
+	case core.EventAddMemberToCard, core.EventRemoveMemberFromCard:
+		if action.Member == nil {
+			break
+		}
+		mention, _ := ch.mentionMember(action.Member)
+		if action.Type == core.EventAddMemberToCard {
+			return fmt.Sprintf("assigned %s", mention)
+		}
+		return fmt.Sprintf("unassigned %s", mention)
+	case core.EventAddChecklistToCard, core.EventCreateCheckItem, core.EventDeleteCheckItem:
+		if action.Data.Checklist == nil {
+			break
+		}
+		switch action.Type {
+		case core.EventAddChecklistToCard:
+			return fmt.Sprintf("added checklist %s", action.Data.Checklist.Name)
+		case core.EventCreateCheckItem:
+			return fmt.Sprintf("added %s to %s", itemName, action.Data.Checklist.Name)
+		default:
+			return fmt.Sprintf("deleted %s from %s", itemName, action.Data.Checklist.Name)
+		}
+	case core.EventUpdateCheckItemStateOnCard:
+		if action.Data.CheckItem != nil && action.Data.CheckItem.State == "complete" {
+			return fmt.Sprintf("completed %s", itemName)
+		}
+		return fmt.Sprintf("marked %s incomplete", itemName)
+	case core.EventAddLabelToCard, core.EventRemoveLabelFromCard, core.EventAddAttachmentToCard, core.EventDeleteAttachmentFromCard:
+		data, err := ch.fetchActionData(ctx.Client, action.ID)
+		if err != nil {
+			log.Warn("Could not fetch action data", "actionId", action.ID, "error", err)
+			break
+		}
+		switch {
+		case data.Label != nil && action.Type == core.EventAddLabelToCard:
+			return fmt.Sprintf("added label %s", ch.renderLabels([]*trello.Label{data.Label}))
+		case data.Label != nil:
+			return fmt.Sprintf("removed label %s", ch.renderLabels([]*trello.Label{data.Label}))
+		case data.Attachment != nil && action.Type == core.EventAddAttachmentToCard:
+			return fmt.Sprintf("attached %s", data.Attachment.Name)
+		case data.Attachment != nil:
+			return fmt.Sprintf("removed attachment %s", data.Attachment.Name)
+		}
+	}
+	return action.Type
+}
+
+// handleEventBatch renders the actions made on a card by a member in a burst
+// as one notification listing the changes.
+func (ch *TrelloChannel) handleEventBatch(ctx *core.TrelloEventCtx, actions []*trello.Action) error {
+	first := actions[0]
+	// A card deleted within the burst is rendered from the action data
+	deleted := false
+	for _, action := range actions {
+		if action.Type == core.EventDeleteCard {
+			deleted = true
+		}
+	}
+	var card *trello.Card
+	if !deleted {
+		var err error
+		card, err = ch.fetchCard(ctx.Client, first.Data.Card.ID)
+		if trello.IsNotFound(err) {
+			deleted = true
+		} else if err != nil {
+			return err
+		}
+	}
+	var msg *discordgo.MessageEmbed
+	if deleted {
+		msg = ch.renderDeletedCard(actions)
+	} else {
+		msg = ch.renderCardEmbed(card, true)
+		msg.Color = ch.eventColor(core.EventUpdateCard, card)
+	}
+	msg.Title = truncateText(fmt.Sprintf("%s made %d changes to a card", first.MemberCreator.FullName, len(actions)), 256)
+	changes := ""
+	mentions := []string{}
+	onlyUpdates := true
+	for _, action := range actions {
+		changes += fmt.Sprintf("• %s\n", ch.describeAction(ctx, action))
+		if action.Type != core.EventUpdateCard {
+			onlyUpdates = false
+		}
+		if action.Type == core.EventAddMemberToCard && action.Member != nil {
+			if mention, linked := ch.mentionMember(action.Member); linked {
+				mentions = append(mentions, mention)
+			}
+		}
+	}
+	// Insert the changes right after the card description
+	changesField := &discordgo.MessageEmbedField{
+		Name:   "📝 Changes",
+		Value:  truncateText(changes, 1024),
+		Inline: false,
+	}
+	msg.Fields = append([]*discordgo.MessageEmbedField{msg.Fields[0], changesField}, msg.Fields[1:]...)
+	send := &discordgo.MessageSend{Content: strings.Join(mentions, " "), Embed: msg}
+	if deleted {
+		return ch.sendDeletedCard(ctx, first.Data.Card.ID, send)
+	}
+	if onlyUpdates {
+		return ch.sendCardUpdate(card, send)
+	}
+	return ch.sendCardMessage(card, send)
+}
+
+// isSilentAction reports the actions that are not notified: comments mirrored
+// from a card thread, which are already on discord, and card position updates.
+func (ch *TrelloChannel) isSilentAction(action *trello.Action) bool {
+	switch action.Type {
+	case core.EventCommentCard:
+		return ch.threads.isMirroredComment(action.ID) || ch.isOwnComment(action)
+	case core.EventUpdateCard:
+		return !action.Data.Card.Closed && action.Data.ListBefore == nil && action.Data.Old != nil && action.Data.Old.Pos != 0
+	}
+	return false
+}
+
+func (ch *TrelloChannel) handleEvent(ctx *core.TrelloEventCtx, action *trello.Action) error {
+	switch action.Type {
+	case core.EventCreateCard:
+		return ch.handleEventCreateCard(ctx, action)
+	case core.EventUpdateCard:
+		return ch.handleEventUpdateCard(ctx, action)
 	case core.EventCopyCard:
-		err = ch.handleEventCreateCard(ctx, action)
+		return ch.handleEventCreateCard(ctx, action)
 	case core.EventDeleteCard:
-		err = ch.handleEventDeleteCard(ctx, action)
+		return ch.handleEventDeleteCard(ctx, action)
 	case core.EventCommentCard:
-		err = ch.handleEventCommentCard(ctx, action)
+		return ch.handleEventCommentCard(ctx, action)
+	case core.EventAddMemberToCard, core.EventRemoveMemberFromCard:
+		return ch.handleEventMemberCard(ctx, action)
+	case core.EventAddMemberToBoard, core.EventRemoveMemberFromBoard:
+		return ch.handleEventMemberBoard(ctx, action)
+	case core.EventAddChecklistToCard, core.EventCreateCheckItem, core.EventDeleteCheckItem, core.EventUpdateCheckItemStateOnCard:
+		return ch.handleEventChecklist(ctx, action)
+	case core.EventAddLabelToCard, core.EventRemoveLabelFromCard:
+		return ch.handleEventLabelCard(ctx, action)
+	case core.EventAddAttachmentToCard, core.EventDeleteAttachmentFromCard:
+		return ch.handleEventAttachmentCard(ctx, action)
 	}
-	if err != nil {
-		ch.session.ChannelMessageSend(ch.channelId, "❌ Internal error occurred, check log for more detail.")
-		log.Error("Could not process board event", "actionId", action.ID, "card", action.Data.Card.ShortLink, "error", err)
+	return nil
+}
+
+// OnTrelloEvents handles the actions grouped by the event coalescer, the
+// actions of a burst on a card are notified together.
+func (ch *TrelloChannel) OnTrelloEvents(ctx *core.TrelloEventCtx, actions []*trello.Action) error {
+	if digest, exist := ch.digest(ctx.IdModel); exist {
+		for _, action := range actions {
+			digest.record(action)
+		}
+	}
+	notified := []*trello.Action{}
+	for _, action := range actions {
+		if !ch.isSilentAction(action) {
+			notified = append(notified, action)
+		}
+	}
+	var err error
+	switch len(notified) {
+	case 0:
+		return nil
+	case 1:
+		err = ch.handleEvent(ctx, notified[0])
+	default:
+		err = ch.handleEventBatch(ctx, notified)
+	}
+	return err
+}
+
+// onEventGap posts a summary of the events missed by the channel, they were
+// too many to be notified one by one.
+func (ch *TrelloChannel) onEventGap(ctx *core.TrelloEventCtx, gap *core.TrelloGap) error {
+	missed := strconv.Itoa(gap.Missed)
+	if gap.Truncated {
+		missed = "More than " + missed
+	}
+	_, err := ch.session.ChannelMessageSend(ch.channelId, fmt.Sprintf("⚠️ %s events of board `%s` were missed, check the board activity on Trello.", missed, ctx.IdModel))
+	return err
+}
+
+// onDeadLetter records the actions that could not be delivered and lets the
+// channel know about them.
+func (ch *TrelloChannel) onDeadLetter(ctx *core.TrelloEventCtx, actions []*trello.Action, err error) {
+	letter := &DeadLetter{
+		ChannelId: ch.channelId,
+		BoardId:   ctx.IdModel,
+		ActionIds: []string{},
+		Error:     err.Error(),
+		FailedAt:  time.Now(),
+	}
+	for _, action := range actions {
+		letter.ActionIds = append(letter.ActionIds, action.ID)
+	}
+	if err := ch.store.AddDeadLetter(letter); err != nil {
+		log.Error("Could not save dead letter", "channelId", ch.channelId, "boardId", ctx.IdModel, "error", err)
 	}
+	ch.session.ChannelMessageSend(ch.channelId, fmt.Sprintf("❌ Could not deliver %d event(s) of board `%s`, check log for more detail.", len(actions), ctx.IdModel))
 }
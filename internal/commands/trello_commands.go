@@ -7,7 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +18,11 @@ import (
 	"github.com/lus/dgc"
 )
 
+const (
+	defaultCoalesceWindow = 5 * time.Second
+	deliveryDrainTimeout  = 10 * time.Second
+)
+
 var (
 	errAlreadyBind = errors.New("already bind")
 )
@@ -27,14 +32,37 @@ type TrelloCmdProcessor struct {
 	allowedRoles []string
 	configFile   string
 	channels     map[string]*TrelloChannel
-	members      map[string]string
+	members      *memberLinks
 	eventHub     *core.TrelloEventHub
-	cancelCtx    context.CancelFunc
-	mtx          sync.Mutex
+	reminder     *DueReminder
+	messageCard  *MessageCardConfig
+	messageCards map[string]string
+	// botMemberId is the trello member of the bot token
+	botMemberId  string
+	updateWindow time.Duration
+	// coalesceWindow is how long the actions on a card are grouped
+	coalesceWindow time.Duration
+	store          StateStore
+	cancelCtx      context.CancelFunc
+	// mtx guards channels and messageCards, the commands, the event
+	// handlers and the background loops run concurrently
+	mtx sync.Mutex
 }
 type moduleConfig struct {
-	Channels []*TrelloChannelConfig `json:"channels"`
-	Members  map[string]string      `json:"members"`
+	// Channels and Members were kept in the config file by older versions,
+	// they are imported into the state store on first start
+	Channels    []*TrelloChannelConfig `json:"channels,omitempty"`
+	Members     map[string]string      `json:"members,omitempty"`
+	DueReminder *DueReminderConfig     `json:"dueReminder,omitempty"`
+	MessageCard *MessageCardConfig     `json:"messageCard,omitempty"`
+	// UpdateWindow is how long the notification of a card keeps being edited
+	// by the card updates, e.g. 30m
+	UpdateWindow string `json:"updateWindow,omitempty"`
+	// CoalesceWindow is how long the actions made on a card by a member are
+	// grouped into one notification, 0s disables grouping
+	CoalesceWindow string `json:"coalesceWindow,omitempty"`
+	// StateFile is where the state is stored, relative to the config file
+	StateFile string `json:"stateFile,omitempty"`
 }
 
 func readConfig(configFile string) (*moduleConfig, error) {
@@ -49,84 +77,114 @@ func readConfig(configFile string) (*moduleConfig, error) {
 	return config, nil
 }
 
-func writeConfig(configFile string, newConfig *moduleConfig) error {
-	buf, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		return err
-	}
-	appConfig, err := unmarshalToMap(buf)
-	if err != nil {
-		return err
-	}
-	appConfig["channels"] = newConfig.Channels
-	appConfig["members"] = newConfig.Members
-	buf, err = json.MarshalIndent(appConfig, "", "  ")
-	if err != nil {
-		return err
-	}
-	if err := os.WriteFile(configFile, buf, 0644); err != nil {
-		return err
+// channel returns the channel subscribed to boards, or nil.
+func (cp *TrelloCmdProcessor) channel(channelId string) *TrelloChannel {
+	cp.mtx.Lock()
+	defer cp.mtx.Unlock()
+	return cp.channels[channelId]
+}
+
+func (cp *TrelloCmdProcessor) channelList() []*TrelloChannel {
+	cp.mtx.Lock()
+	defer cp.mtx.Unlock()
+	ret := make([]*TrelloChannel, 0, len(cp.channels))
+	for _, channel := range cp.channels {
+		ret = append(ret, channel)
 	}
-	log.Info("Config file saved", "channels", len(newConfig.Channels), "members", len(newConfig.Members))
-	return nil
+	return ret
 }
 
 func (cp *TrelloCmdProcessor) subscribeTrello(conf *TrelloChannelConfig) error {
 	cp.mtx.Lock()
 	defer cp.mtx.Unlock()
-	if _, exist := cp.channels[conf.ChannelId]; exist {
-		return errAlreadyBind
+	channel, exist := cp.channels[conf.ChannelId]
+	if !exist {
+		channel = &TrelloChannel{
+			channelId:   conf.ChannelId,
+			session:     cp.botSession,
+			members:     cp.members,
+			listeners:   make(map[string]*core.TrelloEventListener),
+			digests:     make(map[string]*channelDigest),
+			threads:     newCardThreads(),
+			messages:    newCardMessages(cp.updateWindow),
+			store:       cp.store,
+			cursors:     make(map[string]string),
+			botMemberId: cp.botMemberId,
+		}
+		channel.queue = core.NewDeliveryQueue(channel.OnTrelloEvents, channel.onEventGap, channel.commitCursor, channel.onDeadLetter)
+		channel.coalescer = core.NewEventCoalescer(cp.coalesceWindow, channel.queue)
 	}
-	channel := &TrelloChannel{
-		channelId: conf.ChannelId,
-		session:   cp.botSession,
-		members:   cp.members,
+	if channel.GetListener(conf.BoardId) != nil {
+		return errAlreadyBind
 	}
-	listener, err := cp.eventHub.Subscribe(conf.BoardId, conf.EnabledEvents, conf.LastActionId, channel.OnTrelloEvent)
+	listener, err := cp.eventHub.Subscribe(conf.BoardId, conf.ChannelId, conf.EnabledEvents, conf.LastActionId, channel.coalescer.Handle, channel.coalescer.HandleGap)
 	if err != nil {
 		return err
 	}
 	log.Info(fmt.Sprintf("Subscribed Trello boardId: `%s`, channelId: %s, events: [%s]", conf.BoardId, conf.ChannelId, strings.Join(conf.EnabledEvents, ",")))
-	channel.listener = listener
+	channel.mtx.Lock()
+	channel.listeners[conf.BoardId] = listener
+	channel.mtx.Unlock()
+	channel.messages.load(conf.BoardId, conf.CardMessages)
+	channel.cursorMtx.Lock()
+	channel.cursors[conf.BoardId] = conf.LastActionId
+	channel.cursorMtx.Unlock()
 	cp.channels[conf.ChannelId] = channel
+	if conf.Digest != nil {
+		digest, err := newChannelDigest(conf.Digest)
+		if err != nil {
+			log.Error("Invalid digest config", "boardId", conf.BoardId, "channelId", conf.ChannelId, "error", err)
+			return nil
+		}
+		channel.mtx.Lock()
+		channel.digests[conf.BoardId] = digest
+		channel.mtx.Unlock()
+	}
 	return nil
 }
 
-func (cp *TrelloCmdProcessor) unsubscribeTrello(channelId string) {
+func (cp *TrelloCmdProcessor) unsubscribeTrello(channelId string, boardId string) {
 	cp.mtx.Lock()
 	defer cp.mtx.Unlock()
 	channel, exist := cp.channels[channelId]
 	if !exist {
 		return
 	}
-	cp.eventHub.Unsubscribe(channel.BoardId())
-	delete(cp.channels, channelId)
-	log.Info(fmt.Sprintf("Unsubscribed Trello boardId: `%s`, channelId: %s", channel.BoardId(), channel.ChannelId()))
-}
-
-func (cp *TrelloCmdProcessor) getChannelByBoardId(boardId string) *TrelloChannel {
-	for _, channel := range cp.channels {
-		if channel.BoardId() == boardId {
-			return channel
-		}
+	if channel.GetListener(boardId) == nil {
+		return
 	}
-	return nil
+	cp.eventHub.Unsubscribe(boardId, channelId)
+	channel.mtx.Lock()
+	delete(channel.listeners, boardId)
+	delete(channel.digests, boardId)
+	remaining := len(channel.listeners)
+	channel.mtx.Unlock()
+	channel.messages.removeBoard(boardId)
+	if remaining == 0 {
+		delete(cp.channels, channelId)
+		// Drop the deliveries still queued for the channel
+		stopCtx, cancel := context.WithCancel(context.Background())
+		cancel()
+		go channel.queue.Close(stopCtx)
+	}
+	log.Info(fmt.Sprintf("Unsubscribed Trello boardId: `%s`, channelId: %s", boardId, channelId))
 }
 
 func (cp *TrelloCmdProcessor) subscribeBoardHandler(ctx *dgc.Ctx) {
-	boardId := ctx.Arguments.Get(0).Raw()
+	boardId := core.Arguments(ctx).Get(0)
 	_, err := cp.eventHub.Client.GetBoard(boardId, trello.Defaults())
 	if err != nil {
-		ctx.RespondText(fmt.Sprintf("Could not find board %s", boardId))
+		core.RespondText(ctx, fmt.Sprintf("Could not find board %s", boardId))
 		return
 	}
-	listener := cp.eventHub.GetListener(boardId)
+	channelId := targetChannelId(ctx, 1)
+	listener := cp.eventHub.GetListener(boardId, channelId)
 	if listener != nil {
-		ctx.RespondText(fmt.Sprintf("Already watching board %s", boardId))
+		core.RespondText(ctx, fmt.Sprintf("<#%s> is already watching board %s", channelId, boardId))
 		return
 	}
 	conf := &TrelloChannelConfig{
-		ChannelId: ctx.Event.ChannelID,
+		ChannelId: channelId,
 		BoardId:   boardId,
 		EnabledEvents: []string{
 			core.EventCreateCard,
@@ -138,64 +196,218 @@ func (cp *TrelloCmdProcessor) subscribeBoardHandler(ctx *dgc.Ctx) {
 	}
 	if err := cp.subscribeTrello(conf); err != nil {
 		log.Error(fmt.Sprintf("Could not subscribe board %s", boardId), "channelId", conf.ChannelId, "error", err)
-		ctx.RespondText(fmt.Sprintf("Failed to subscribe board events, see log for more detail. (boardId: %s)", boardId))
+		core.RespondText(ctx, fmt.Sprintf("Failed to subscribe board events, see log for more detail. (boardId: %s)", boardId))
 		return
 	}
-	ctx.RespondText(fmt.Sprintf("Subscribed Trello board `%s` and notify to this channel", boardId))
+	cp.saveState()
+	core.RespondText(ctx, fmt.Sprintf("Subscribed Trello board `%s` and notify to <#%s>", boardId, channelId))
 }
 
 func (cp *TrelloCmdProcessor) unsubscribeBoardHandler(ctx *dgc.Ctx) {
-	boardId := ctx.Arguments.Get(0).Raw()
-	var channel *TrelloChannel
-	if boardId != "" {
-		channel = cp.getChannelByBoardId(boardId)
-	} else {
-		channel = cp.channels[ctx.Event.ChannelID]
+	boardId := core.Arguments(ctx).Get(0)
+	channel := cp.channel(targetChannelId(ctx, 1))
+	if channel == nil || (boardId != "" && channel.GetListener(boardId) == nil) {
+		core.RespondText(ctx, "❌ Trello board not found.")
+		return
+	}
+	boardIds := []string{boardId}
+	if boardId == "" {
+		boardIds = channel.BoardIds()
+	}
+	for _, boardId := range boardIds {
+		cp.unsubscribeTrello(channel.ChannelId(), boardId)
+	}
+	cp.saveState()
+	core.RespondText(ctx, "OK!")
+}
+
+func (cp *TrelloCmdProcessor) eventsHandler(ctx *dgc.Ctx) {
+	args := core.Arguments(ctx)
+	boardId, action, eventType := args.Get(0), args.Get(1), args.Get(2)
+	channelId := ctx.Event.ChannelID
+	enabledEvents, err := cp.eventHub.EnabledEvents(boardId, channelId)
+	if err != nil {
+		core.RespondText(ctx, "❌ Trello board not found.")
+		return
+	}
+	if action == "list" || action == "" {
+		core.RespondText(ctx, fmt.Sprintf("Enabled events of board `%s`: %s", boardId, formatEventList(enabledEvents)))
+		return
+	}
+	if action != "add" && action != "remove" {
+		core.RespondText(ctx, "❌ Invalid arguments provided.")
+		return
+	}
+	if !core.IsTrelloEvent(eventType) {
+		core.RespondText(ctx, fmt.Sprintf("❌ Unknown event type `%s`, available events: %s", eventType, formatEventList(core.TrelloEvents)))
+		return
+	}
+	enabled := false
+	events := []string{}
+	for _, event := range enabledEvents {
+		if event == eventType {
+			enabled = true
+			continue
+		}
+		events = append(events, event)
+	}
+	if action == "add" {
+		if enabled {
+			core.RespondText(ctx, fmt.Sprintf("Event `%s` is already enabled.", eventType))
+			return
+		}
+		events = append(events, eventType)
+	} else if !enabled {
+		core.RespondText(ctx, fmt.Sprintf("Event `%s` is not enabled.", eventType))
+		return
+	}
+	if err := cp.eventHub.SetEnabledEvents(boardId, channelId, events); err != nil {
+		log.Error("Could not update enabled events", "boardId", boardId, "channelId", channelId, "error", err)
+		core.RespondText(ctx, "❌ Internal error occurred, check log for more detail.")
+		return
+	}
+	cp.saveState()
+	core.RespondText(ctx, fmt.Sprintf("Enabled events of board `%s`: %s", boardId, formatEventList(events)))
+}
+
+func (cp *TrelloCmdProcessor) pollHandler(ctx *dgc.Ctx) {
+	args := core.Arguments(ctx)
+	boardId, when := args.Get(0), args.Get(1)
+	if when == "now" {
+		if err := cp.eventHub.PollNow(boardId); err != nil {
+			core.RespondText(ctx, "❌ Trello board not found.")
+			return
+		}
+		core.RespondText(ctx, fmt.Sprintf("Fetching the events of board `%s` now.", boardId))
+		return
+	}
+	if when != "" {
+		core.RespondText(ctx, "❌ Invalid arguments provided.")
+		return
+	}
+	status, err := cp.eventHub.PollStatus(boardId)
+	if err != nil {
+		core.RespondText(ctx, "❌ Trello board not found.")
+		return
+	}
+	if status.Webhook {
+		core.RespondText(ctx, fmt.Sprintf("Events of board `%s` are pushed by its webhook, it is still polled every %s in case the webhook is disabled, next poll <t:%d:R>.", boardId, status.Interval, status.NextPoll.Unix()))
+		return
+	}
+	core.RespondText(ctx, fmt.Sprintf("Board `%s` is polled every %s, next poll <t:%d:R>.", boardId, status.Interval, status.NextPoll.Unix()))
+}
+
+func (cp *TrelloCmdProcessor) digestHandler(ctx *dgc.Ctx) {
+	args := core.Arguments(ctx)
+	boardId, schedule := args.Get(0), args.Get(1)
+	channel := cp.channel(ctx.Event.ChannelID)
+	if channel == nil || channel.GetListener(boardId) == nil {
+		core.RespondText(ctx, "❌ Trello board not found.")
+		return
+	}
+	current, exist := channel.digest(boardId)
+	if schedule == "" {
+		if !exist {
+			core.RespondText(ctx, fmt.Sprintf("Board `%s` has no digest.", boardId))
+			return
+		}
+		conf := current.config()
+		core.RespondText(ctx, fmt.Sprintf("Digest of board `%s` is posted on `%s`, done lists: %s", boardId, conf.Schedule, formatEventList(conf.DoneLists)))
+		return
 	}
-	if channel != nil {
-		cp.unsubscribeTrello(channel.ChannelId())
-		ctx.RespondText("OK!")
+	if schedule == "off" {
+		channel.mtx.Lock()
+		delete(channel.digests, boardId)
+		channel.mtx.Unlock()
+		cp.saveState()
+		core.RespondText(ctx, fmt.Sprintf("Disabled the digest of board `%s`.", boardId))
 		return
 	}
-	ctx.RespondText("❌ Trello board not found.")
+	conf := &DigestConfig{Schedule: schedule}
+	for _, name := range strings.Split(args.Get(2), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			conf.DoneLists = append(conf.DoneLists, name)
+		}
+	}
+	// A changed schedule still covers the actions since the last digest
+	if exist {
+		previous := current.config()
+		conf.LastSent = previous.LastSent
+		if len(conf.DoneLists) == 0 {
+			conf.DoneLists = previous.DoneLists
+		}
+	}
+	digest, err := newChannelDigest(conf)
+	if err != nil {
+		core.RespondText(ctx, fmt.Sprintf("❌ Invalid schedule `%s`: %s", schedule, err))
+		return
+	}
+	next := digest.next
+	channel.mtx.Lock()
+	channel.digests[boardId] = digest
+	channel.mtx.Unlock()
+	cp.saveState()
+	core.RespondText(ctx, fmt.Sprintf("Digest of board `%s` is posted on `%s`, done lists: %s, next digest <t:%d:R>.", boardId, conf.Schedule, formatEventList(digest.doneLists), next.Unix()))
 }
 
 func (cp *TrelloCmdProcessor) memaddHandler(ctx *dgc.Ctx) {
-	trelloUsername := ctx.Arguments.Get(0).Raw()
-	discordUser := ctx.Arguments.Get(1).Raw()
+	args := core.Arguments(ctx)
+	trelloUsername, discordUser := args.Get(0), args.Get(1)
 	if userId, ok := parseUserId(discordUser); len(trelloUsername) > 0 && ok {
-		cp.members[trelloUsername] = userId
-		ctx.RespondText(fmt.Sprintf("Linked trello username `%s` to user <@%s>", trelloUsername, userId))
+		cp.members.set(trelloUsername, userId)
+		cp.saveState()
+		core.RespondText(ctx, fmt.Sprintf("Linked trello username `%s` to user <@%s>", trelloUsername, userId))
 		return
 	}
-	ctx.RespondText("❌ Invalid arguments provided.")
+	core.RespondText(ctx, "❌ Invalid arguments provided.")
 }
 
 func (cp *TrelloCmdProcessor) memdelHandler(ctx *dgc.Ctx) {
-	trelloUsername := ctx.Arguments.Get(0).Raw()
-	if userId, ok := cp.members[trelloUsername]; ok {
-		delete(cp.members, trelloUsername)
-		ctx.RespondText(fmt.Sprintf("Unlinked trello username `%s` from user <@%s>", trelloUsername, userId))
+	trelloUsername := core.Arguments(ctx).Get(0)
+	if userId, ok := cp.members.remove(trelloUsername); ok {
+		cp.saveState()
+		core.RespondText(ctx, fmt.Sprintf("Unlinked trello username `%s` from user <@%s>", trelloUsername, userId))
 		return
 	}
-	ctx.RespondText("❌ Trello username not linked with any discord user.")
+	core.RespondText(ctx, "❌ Trello username not linked with any discord user.")
 }
 
 func (cp *TrelloCmdProcessor) RegisterCommands(cmdRouter *dgc.Router) {
 	cmdRouter.RegisterCmd(&dgc.Command{
 		Name:        "subscribe",
 		Aliases:     []string{"sub"},
-		Description: "Subscribe to receive events of a board on the current channel",
-		Usage:       "subscribe <boardId>",
+		Description: "Subscribe to receive events of a board on the current or given channel",
+		Usage:       "subscribe <boardId> [#channel]",
 		Handler:     cp.subscribeBoardHandler,
 	})
 	cmdRouter.RegisterCmd(&dgc.Command{
 		Name:        "unsubscribe",
 		Aliases:     []string{"unsub"},
-		Description: "Unsubscribe from board events of the current channel",
-		Usage:       "unsubscribe [boardId]",
+		Description: "Unsubscribe the current or given channel from a board, or from all its boards if no board is given",
+		Usage:       "unsubscribe [boardId] [#channel]",
 		Handler:     cp.unsubscribeBoardHandler,
 	})
+	cmdRouter.RegisterCmd(&dgc.Command{
+		Name:        "events",
+		Description: "List, enable or disable the events of a board notified on the current channel",
+		Usage:       "events <boardId> add|remove|list [eventType]",
+		Example:     "events 6408ceabbddcacfe1ed9ade9 add addMemberToCard",
+		Handler:     cp.eventsHandler,
+	})
+	cmdRouter.RegisterCmd(&dgc.Command{
+		Name:        "poll",
+		Description: "Show when a board is polled, or fetch its events now",
+		Usage:       "poll <boardId> [now]",
+		Example:     "poll 6408ceabbddcacfe1ed9ade9 now",
+		Handler:     cp.pollHandler,
+	})
+	cmdRouter.RegisterCmd(&dgc.Command{
+		Name:        "digest",
+		Description: "Show, set or disable the periodic digest of a board posted on the current channel",
+		Usage:       "digest <boardId> [off|\"<schedule>\"] [doneLists]",
+		Example:     "digest 6408ceabbddcacfe1ed9ade9 \"0 9 * * 1\" Done,Released",
+		Handler:     cp.digestHandler,
+	})
 	cmdRouter.RegisterCmd(&dgc.Command{
 		Name:        "memadd",
 		Aliases:     []string{"memreg"},
@@ -209,29 +421,108 @@ func (cp *TrelloCmdProcessor) RegisterCommands(cmdRouter *dgc.Router) {
 		Usage:       "memdel <trello username> <discord user>",
 		Handler:     cp.memdelHandler,
 	})
+	cp.registerCardCommands(cmdRouter)
 }
 
-func (cp *TrelloCmdProcessor) saveConfig() {
-	channels := []*TrelloChannelConfig{}
+// saveState holds the lock until the state is written, so a state built
+// before a subscription change never overwrites the one built after it.
+func (cp *TrelloCmdProcessor) saveState() {
+	cp.mtx.Lock()
+	defer cp.mtx.Unlock()
+	subscriptions := []*TrelloChannelConfig{}
 	for _, channel := range cp.channels {
-		conf := TrelloChannelConfig{
-			ChannelId:     channel.ChannelId(),
-			BoardId:       channel.BoardId(),
-			EnabledEvents: channel.listener.EnabledEvents,
-			LastActionId:  channel.listener.LastActionId,
+		for _, boardId := range channel.BoardIds() {
+			enabledEvents, err := cp.eventHub.EnabledEvents(boardId, channel.ChannelId())
+			if err != nil {
+				continue
+			}
+			conf := TrelloChannelConfig{
+				ChannelId:     channel.ChannelId(),
+				BoardId:       boardId,
+				EnabledEvents: enabledEvents,
+				LastActionId:  channel.cursor(boardId),
+				CardMessages:  channel.messages.config(boardId),
+			}
+			if digest, exist := channel.digest(boardId); exist {
+				conf.Digest = digest.config()
+			}
+			subscriptions = append(subscriptions, &conf)
+		}
+	}
+	messageCards := make(map[string]string, len(cp.messageCards))
+	for messageId, cardURL := range cp.messageCards {
+		// Cards still being created are saved once created
+		if cardURL != "" {
+			messageCards[messageId] = cardURL
 		}
-		channels = append(channels, &conf)
 	}
-	if err := writeConfig(cp.configFile, &moduleConfig{channels, cp.members}); err != nil {
-		log.Error("Could not save channels config", "error", err)
+	state := &State{Subscriptions: subscriptions, Members: cp.members.config(), MessageCards: messageCards}
+	if cp.reminder != nil {
+		state.DueReminders = cp.reminder.config()
 	}
+	if err := cp.store.Save(state); err != nil {
+		log.Error("Could not save state", "error", err)
+		return
+	}
+	log.Debug("State saved", "subscriptions", len(subscriptions), "members", len(state.Members))
+}
+
+// loadState loads the state, importing it from the config file on the first
+// start with a state store.
+func (cp *TrelloCmdProcessor) loadState(config *moduleConfig) (*State, error) {
+	state, err := cp.store.Load()
+	if err != nil || state != nil {
+		return state, err
+	}
+	state = migrateState(config)
+	if err := cp.store.Save(state); err != nil {
+		return nil, err
+	}
+	log.Info("Imported subscriptions and members from the config file into the state store, their config sections can be removed",
+		"subscriptions", len(state.Subscriptions), "members", len(state.Members))
+	return state, nil
 }
 
 func (cp *TrelloCmdProcessor) saveLoop(ctx context.Context) {
 	for {
 		select {
 		case <-time.After(1 * time.Minute):
-			cp.saveConfig()
+			cp.saveState()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cp *TrelloCmdProcessor) sendDigests() {
+	type pendingDigest struct {
+		channel *TrelloChannel
+		boardId string
+		digest  *channelDigest
+	}
+	now := time.Now()
+	pending := []*pendingDigest{}
+	for _, channel := range cp.channelList() {
+		channel.mtx.Lock()
+		for boardId, digest := range channel.digests {
+			if digest.due(now) {
+				pending = append(pending, &pendingDigest{channel, boardId, digest})
+			}
+		}
+		channel.mtx.Unlock()
+	}
+	for _, item := range pending {
+		if err := item.channel.sendDigest(cp.eventHub.Client, item.boardId, item.digest, now); err != nil {
+			log.Error("Could not send board digest", "boardId", item.boardId, "channelId", item.channel.ChannelId(), "error", err)
+		}
+	}
+}
+
+func (cp *TrelloCmdProcessor) digestLoop(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(1 * time.Minute):
+			cp.sendDigests()
 		case <-ctx.Done():
 			return
 		}
@@ -246,20 +537,85 @@ func (cp *TrelloCmdProcessor) OnStartBot(session *discordgo.Session) error {
 	if err != nil {
 		return err
 	}
-	cp.members = config.Members
-	for _, conf := range config.Channels {
+	if cp.store == nil {
+		stateFile := config.StateFile
+		if stateFile == "" {
+			stateFile = defaultStateFile
+		}
+		if !filepath.IsAbs(stateFile) {
+			stateFile = filepath.Join(filepath.Dir(cp.configFile), stateFile)
+		}
+		cp.store = NewFileStateStore(stateFile)
+	}
+	state, err := cp.loadState(config)
+	if err != nil {
+		return fmt.Errorf("could not load state: %w", err)
+	}
+	cp.members.load(state.Members)
+	// The comments mirrored by the bot are recognized by their author
+	if me, err := cp.eventHub.Client.GetMember("me", trello.Arguments{"fields": "username"}); err != nil {
+		log.Warn("Could not fetch the trello member of the bot, comments mirrored before a restart may be notified back", "error", err)
+	} else {
+		cp.botMemberId = me.ID
+	}
+	cp.mtx.Lock()
+	for messageId, cardURL := range state.MessageCards {
+		cp.messageCards[messageId] = cardURL
+	}
+	cp.mtx.Unlock()
+	if config.UpdateWindow != "" {
+		if cp.updateWindow, err = time.ParseDuration(config.UpdateWindow); err != nil {
+			return fmt.Errorf("invalid update window %s: %w", config.UpdateWindow, err)
+		}
+	}
+	if config.CoalesceWindow != "" {
+		if cp.coalesceWindow, err = time.ParseDuration(config.CoalesceWindow); err != nil {
+			return fmt.Errorf("invalid coalesce window %s: %w", config.CoalesceWindow, err)
+		}
+	}
+	// The settings are all checked before subscribing, so an invalid config
+	// never leaves subscriptions without a running event hub
+	if config.DueReminder != nil {
+		if cp.reminder, err = NewDueReminder(cp, config.DueReminder); err != nil {
+			return err
+		}
+		cp.reminder.load(state.DueReminders)
+	}
+	for _, conf := range state.Subscriptions {
 		if err := cp.subscribeTrello(conf); err != nil {
 			log.Error(fmt.Sprintf("Failed to create trello channel. channelId: %s, boardId: %s", conf.ChannelId, conf.BoardId), "error", err)
 		}
 	}
+	if cp.reminder != nil {
+		go cp.reminder.Run(ctx)
+	}
+	cp.messageCard = config.MessageCard
+	if cp.messageCard != nil && cp.messageCard.Emoji != "" {
+		session.AddHandler(cp.onMessageReactionAdd)
+	}
+	session.AddHandler(cp.onThreadMessage)
 	go cp.eventHub.Run(ctx)
 	go cp.saveLoop(ctx)
+	go cp.digestLoop(ctx)
 	return nil
 }
 
 func (cp *TrelloCmdProcessor) OnStopBot() {
 	cp.cancelCtx()
-	cp.saveConfig()
+	// Give the queued deliveries a moment to complete, the others are
+	// delivered again after a restart
+	drainCtx, cancel := context.WithTimeout(context.Background(), deliveryDrainTimeout)
+	defer cancel()
+	for _, channel := range cp.channelList() {
+		channel.coalescer.Flush()
+		channel.queue.Close(drainCtx)
+	}
+	cp.saveState()
+}
+
+// SetStateStore replaces the file state store configured by stateFile.
+func (cp *TrelloCmdProcessor) SetStateStore(store StateStore) {
+	cp.store = store
 }
 
 func (cp *TrelloCmdProcessor) SetAllowedRoles(roles []string) {
@@ -268,8 +624,12 @@ func (cp *TrelloCmdProcessor) SetAllowedRoles(roles []string) {
 
 func NewTrelloCommandProcessor(channelCfg string, trelloEventHub *core.TrelloEventHub) (*TrelloCmdProcessor, error) {
 	return &TrelloCmdProcessor{
-		configFile: channelCfg,
-		eventHub:   trelloEventHub,
-		channels:   make(map[string]*TrelloChannel),
+		configFile:     channelCfg,
+		eventHub:       trelloEventHub,
+		channels:       make(map[string]*TrelloChannel),
+		members:        newMemberLinks(),
+		messageCards:   make(map[string]string),
+		updateWindow:   defaultUpdateWindow,
+		coalesceWindow: defaultCoalesceWindow,
 	}, nil
 }
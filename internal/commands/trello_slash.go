@@ -0,0 +1,263 @@
+package commands
+
+import (
+	"dgtrello/internal/core"
+	"strings"
+
+	"github.com/adlio/trello"
+	"github.com/bwmarrin/discordgo"
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	maxAutocompleteChoices = 25
+)
+
+var (
+	channelOption = &discordgo.ApplicationCommandOption{
+		Type:         discordgo.ApplicationCommandOptionChannel,
+		Name:         "channel",
+		Description:  "Discord channel, default to the current channel",
+		ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+	}
+	usernameOption = &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "username",
+		Description: "Trello username",
+		Required:    true,
+	}
+)
+
+func newBoardOption(required bool) *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:         discordgo.ApplicationCommandOptionString,
+		Name:         "board",
+		Description:  "Trello board",
+		Required:     required,
+		Autocomplete: true,
+	}
+}
+
+func newStringChoices(values []string) []*discordgo.ApplicationCommandOptionChoice {
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	for _, value := range values {
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: value, Value: value})
+	}
+	return choices
+}
+
+// ApplicationCommands exposes the prefix commands as subcommands of /trello,
+// option order must match the arguments of the prefix command.
+func (cp *TrelloCmdProcessor) ApplicationCommands() []*discordgo.ApplicationCommand {
+	return []*discordgo.ApplicationCommand{
+		{
+			Name:        "trello",
+			Description: "Trello board notifications",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "subscribe",
+					Description: "Subscribe to receive events of a board on a channel",
+					Options:     []*discordgo.ApplicationCommandOption{newBoardOption(true), channelOption},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "unsubscribe",
+					Description: "Unsubscribe a channel from a board, or from all its boards if no board is given",
+					Options:     []*discordgo.ApplicationCommandOption{newBoardOption(false), channelOption},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "events",
+					Description: "List, enable or disable the events of a board notified on this channel",
+					Options: []*discordgo.ApplicationCommandOption{
+						newBoardOption(true),
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "action",
+							Description: "What to do with the event",
+							Required:    true,
+							Choices:     newStringChoices([]string{"list", "add", "remove"}),
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "event",
+							Description: "Event type",
+							Choices:     newStringChoices(core.TrelloEvents),
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "poll",
+					Description: "Show when a board is polled, or fetch its events now",
+					Options: []*discordgo.ApplicationCommandOption{
+						newBoardOption(true),
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "when",
+							Description: "Fetch the board events now",
+							Choices:     newStringChoices([]string{"now"}),
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "digest",
+					Description: "Show, set or disable the periodic digest of a board posted on this channel",
+					Options: []*discordgo.ApplicationCommandOption{
+						newBoardOption(true),
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "schedule",
+							Description: "Cron expression, @hourly, @daily, @weekly, @monthly, or off",
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "done_lists",
+							Description: "Comma separated names of the lists of done cards",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+					Name:        "card",
+					Description: "Manage the cards of the boards subscribed by this channel",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "create",
+							Description: "Create a card on a list of the boards subscribed by this channel",
+							Options: []*discordgo.ApplicationCommandOption{
+								{
+									Type:         discordgo.ApplicationCommandOptionString,
+									Name:         "list",
+									Description:  "Trello list",
+									Required:     true,
+									Autocomplete: true,
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "title",
+									Description: "Card title",
+									Required:    true,
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "description",
+									Description: "Card description",
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionUser,
+									Name:        "assignee",
+									Description: "Discord user linked to the trello member to assign",
+								},
+							},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "memadd",
+					Description: "Link a trello username to a discord user",
+					Options: []*discordgo.ApplicationCommandOption{
+						usernameOption,
+						{
+							Type:        discordgo.ApplicationCommandOptionUser,
+							Name:        "user",
+							Description: "Discord user",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "memdel",
+					Description: "Unlink a trello username from its discord user",
+					Options:     []*discordgo.ApplicationCommandOption{usernameOption},
+				},
+			},
+		},
+	}
+}
+
+// ContextMenuCommands adds a message action creating a card from the message.
+func (cp *TrelloCmdProcessor) ContextMenuCommands() []*core.ContextMenuCommand {
+	return []*core.ContextMenuCommand{
+		{
+			ApplicationCommand: &discordgo.ApplicationCommand{
+				Type: discordgo.MessageApplicationCommand,
+				Name: "Create Trello card",
+			},
+			CmdPath: []string{"card", "message"},
+		},
+	}
+}
+
+// Autocomplete suggests the boards of the trello member matching the typed
+// text, unsubscribe, events, poll and digest only suggest the boards
+// subscribed by the channel. Lists are suggested from the boards subscribed by
+// the channel.
+func (cp *TrelloCmdProcessor) Autocomplete(interaction *discordgo.Interaction, cmdName string, option *discordgo.ApplicationCommandInteractionDataOption) []*discordgo.ApplicationCommandOptionChoice {
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	if option.Name == "list" {
+		return cp.autocompleteList(interaction, option)
+	}
+	if option.Name != "board" {
+		return choices
+	}
+	boards, err := cp.eventHub.Client.GetMyBoards(trello.Arguments{"filter": "open", "fields": "name"})
+	if err != nil {
+		log.Error("Could not fetch trello boards", "error", err)
+		return choices
+	}
+	channel := cp.channel(interaction.ChannelID)
+	keyword := strings.ToLower(option.StringValue())
+	for _, board := range boards {
+		if (cmdName == "unsubscribe" || cmdName == "events" || cmdName == "poll" || cmdName == "digest") && (channel == nil || channel.GetListener(board.ID) == nil) {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(board.Name), keyword) {
+			continue
+		}
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  truncateText(board.Name, 100),
+			Value: board.ID,
+		})
+		if len(choices) >= maxAutocompleteChoices {
+			break
+		}
+	}
+	return choices
+}
+
+func (cp *TrelloCmdProcessor) autocompleteList(interaction *discordgo.Interaction, option *discordgo.ApplicationCommandInteractionDataOption) []*discordgo.ApplicationCommandOptionChoice {
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	channel := cp.channel(interaction.ChannelID)
+	if channel == nil {
+		return choices
+	}
+	keyword := strings.ToLower(option.StringValue())
+	for _, boardId := range channel.BoardIds() {
+		board := trello.Board{ID: boardId}
+		board.SetClient(cp.eventHub.Client)
+		lists, err := board.GetLists(trello.Arguments{"filter": "open", "fields": "name"})
+		if err != nil {
+			log.Error("Could not fetch board lists", "boardId", boardId, "error", err)
+			continue
+		}
+		for _, list := range lists {
+			if !strings.Contains(strings.ToLower(list.Name), keyword) {
+				continue
+			}
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+				Name:  truncateText(list.Name, 100),
+				Value: list.ID,
+			})
+			if len(choices) >= maxAutocompleteChoices {
+				return choices
+			}
+		}
+	}
+	return choices
+}
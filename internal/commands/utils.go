@@ -1,13 +1,21 @@
 package commands
 
-import "encoding/json"
+import (
+	"dgtrello/internal/core"
+	"path"
+	"strings"
+
+	"github.com/adlio/trello"
+	"github.com/lus/dgc"
+)
 
 const (
 	trelloUrl = "https://trello.com"
 )
 
 var (
-	labelColors = map[string]int{
+	imageExtensions = []string{".png", ".jpg", ".jpeg", ".gif", ".webp"}
+	labelColors     = map[string]int{
 		"green":  0x7bc86c,
 		"yellow": 0xf5dd29,
 		"orange": 0xffaf3f,
@@ -21,12 +29,27 @@ var (
 	}
 )
 
-func unmarshalToMap(data []byte) (map[string]interface{}, error) {
-	ret := make(map[string]interface{})
-	if err := json.Unmarshal(data, &ret); err != nil {
-		return nil, err
+// labelColor returns the embed color of a trello label color, variants like
+// "green_dark" fall back to their base color.
+func labelColor(color string) (int, bool) {
+	if value, ok := labelColors[color]; ok {
+		return value, true
+	}
+	value, ok := labelColors[strings.Split(color, "_")[0]]
+	return value, ok
+}
+
+func isImageAttachment(attachment *trello.Attachment) bool {
+	if strings.HasPrefix(attachment.MimeType, "image/") {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(attachment.URL))
+	for _, imageExt := range imageExtensions {
+		if ext == imageExt {
+			return true
+		}
 	}
-	return ret, nil
+	return false
 }
 
 func parseUserId(str string) (string, bool) {
@@ -36,6 +59,22 @@ func parseUserId(str string) (string, bool) {
 	return "", false
 }
 
+// targetChannelId returns the channel mentioned by the n'th argument, or the
+// channel the command was sent from if there is no such mention.
+func targetChannelId(ctx *dgc.Ctx, n int) string {
+	if matches := dgc.RegexChannelMention.FindStringSubmatch(core.Arguments(ctx).Get(n)); matches != nil {
+		return matches[1]
+	}
+	return ctx.Event.ChannelID
+}
+
+func formatEventList(events []string) string {
+	if len(events) == 0 {
+		return "none"
+	}
+	return "`" + strings.Join(events, "`, `") + "`"
+}
+
 func truncateText(str string, maxLen uint) string {
 	if len(str) <= int(maxLen) {
 		return str
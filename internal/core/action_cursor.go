@@ -0,0 +1,108 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/adlio/trello"
+)
+
+// ActionIdTime returns the creation time embedded in an action id. Trello ids
+// are Mongo ObjectIDs, whose first 4 bytes are the creation time in seconds.
+func ActionIdTime(id string) (time.Time, bool) {
+	if len(id) != 24 {
+		return time.Time{}, false
+	}
+	buf, err := hex.DecodeString(id)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(buf[:4])), 0), true
+}
+
+// ActionIdBefore reports whether action id a was created in an earlier second
+// than b, an empty or malformed id is older than any valid one.
+func ActionIdBefore(a string, b string) bool {
+	timeA, okA := ActionIdTime(a)
+	timeB, okB := ActionIdTime(b)
+	if !okB {
+		return false
+	}
+	return !okA || timeA.Before(timeB)
+}
+
+// actionTime returns when an action was made. Its date is preferred to the
+// time of its id, which is only precise to the second.
+func actionTime(action *trello.Action) time.Time {
+	if !action.Date.IsZero() {
+		return action.Date
+	}
+	t, _ := ActionIdTime(action.ID)
+	return t
+}
+
+// sortActions sorts actions oldest first, the actions made at the same time
+// are ordered by id so the order is stable between fetches.
+func sortActions(actions []*trello.Action) {
+	sort.SliceStable(actions, func(i, j int) bool {
+		timeI, timeJ := actionTime(actions[i]), actionTime(actions[j])
+		if !timeI.Equal(timeJ) {
+			return timeI.Before(timeJ)
+		}
+		return actions[i].ID < actions[j].ID
+	})
+}
+
+// actionCursor tracks the actions delivered to a listener: the time of the
+// latest polled one, and the ids of those seen since that time. An action is
+// new when it is not older than the cursor and not seen yet. Only polls move
+// the cursor, they fetch every action of the board since then.
+type actionCursor struct {
+	time time.Time
+	seen map[string]time.Time
+}
+
+func (c *actionCursor) isNew(action *trello.Action) bool {
+	if actionTime(action).Before(c.time) {
+		return false
+	}
+	_, seen := c.seen[action.ID]
+	return !seen
+}
+
+func (c *actionCursor) advance(action *trello.Action) {
+	t := actionTime(action)
+	c.seen[action.ID] = t
+	if !t.After(c.time) {
+		return
+	}
+	c.time = t
+	// Older actions are rejected by their time
+	for id, seenAt := range c.seen {
+		if seenAt.Before(c.time) {
+			delete(c.seen, id)
+		}
+	}
+}
+
+// mark records an action as seen without moving the cursor. Actions pushed by
+// webhooks are marked only, so an earlier action they skipped is still new
+// for the next poll.
+func (c *actionCursor) mark(action *trello.Action) {
+	c.seen[action.ID] = actionTime(action)
+}
+
+// newActionCursor restores a cursor from the id of the last delivered action,
+// a cursor without a valid id accepts every action.
+func newActionCursor(lastActionId string) *actionCursor {
+	c := &actionCursor{seen: map[string]time.Time{}}
+	if t, ok := ActionIdTime(lastActionId); ok {
+		c.time = t
+		// The action was made within that second, it is kept as seen until
+		// the cursor moves past it
+		c.seen[lastActionId] = t.Add(time.Second - time.Nanosecond)
+	}
+	return c
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adlio/trello"
+)
+
+var cursorBase = time.Unix(0x64000000, 0)
+
+func testAction(id string, offset time.Duration) *trello.Action {
+	return &trello.Action{ID: id, Date: cursorBase.Add(offset)}
+}
+
+func TestActionIdTime(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want time.Time
+		ok   bool
+	}{
+		{"valid", "640000000000000000000001", cursorBase, true},
+		{"empty", "", time.Time{}, false},
+		{"too short", "64000000", time.Time{}, false},
+		{"not hex", "64000000000000000000zzzz", time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, ok := ActionIdTime(test.id)
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("%s: ActionIdTime(%q) = %v, %v, want %v, %v", test.name, test.id, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestActionIdBefore(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"older second", "640000000000000000000001", "640000010000000000000000", true},
+		{"newer second", "640000010000000000000000", "640000000000000000000001", false},
+		{"same second", "640000000000000000000002", "640000000000000000000001", false},
+		{"empty before valid", "", "640000000000000000000001", true},
+		{"malformed before valid", "bogus", "640000000000000000000001", true},
+		{"valid after empty", "640000000000000000000001", "", false},
+		{"both empty", "", "", false},
+	}
+	for _, test := range tests {
+		if got := ActionIdBefore(test.a, test.b); got != test.want {
+			t.Errorf("%s: ActionIdBefore(%q, %q) = %v, want %v", test.name, test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSortActions(t *testing.T) {
+	// Actions of the same second ordered by their date, then by id
+	first := testAction("6400000000000000000000ff", 100*time.Millisecond)
+	second := testAction("640000000000000000000001", 700*time.Millisecond)
+	third := testAction("640000000000000000000002", 700*time.Millisecond)
+	undated := &trello.Action{ID: "640000010000000000000000"}
+	actions := []*trello.Action{undated, third, first, second}
+	sortActions(actions)
+	want := []*trello.Action{first, second, third, undated}
+	for idx := range want {
+		if actions[idx] != want[idx] {
+			t.Fatalf("action %d is %s, want %s", idx, actions[idx].ID, want[idx].ID)
+		}
+	}
+}
+
+func TestActionCursor(t *testing.T) {
+	last := testAction("640000000000000000000001", 800*time.Millisecond)
+	sibling := testAction("640000000000000000000002", 900*time.Millisecond)
+	earlier := testAction("63ffffff0000000000000000", -time.Second)
+	next := testAction("640000010000000000000000", 1200*time.Millisecond)
+	tests := []struct {
+		name    string
+		cursor  string
+		advance []*trello.Action
+		action  *trello.Action
+		want    bool
+	}{
+		{"empty cursor accepts all", "", nil, earlier, true},
+		{"malformed cursor accepts all", "bogus", nil, earlier, true},
+		{"restored cursor skips its action", last.ID, nil, last, false},
+		{"restored cursor accepts a sibling", last.ID, nil, sibling, true},
+		{"restored cursor skips older actions", last.ID, nil, earlier, false},
+		{"delivered sibling is skipped", last.ID, []*trello.Action{sibling}, sibling, false},
+		{"restored action stays seen within its second", last.ID, []*trello.Action{sibling}, last, false},
+		{"moved past the second", last.ID, []*trello.Action{sibling, next}, last, false},
+		{"newer action is accepted", last.ID, []*trello.Action{sibling}, next, true},
+	}
+	for _, test := range tests {
+		cursor := newActionCursor(test.cursor)
+		for _, action := range test.advance {
+			cursor.advance(action)
+		}
+		if got := cursor.isNew(test.action); got != test.want {
+			t.Errorf("%s: isNew(%s) = %v, want %v", test.name, test.action.ID, got, test.want)
+		}
+	}
+}
+
+func TestActionCursorPrunesSeen(t *testing.T) {
+	cursor := newActionCursor("640000000000000000000001")
+	cursor.advance(testAction("640000000000000000000002", 900*time.Millisecond))
+	if len(cursor.seen) != 2 {
+		t.Fatalf("expected 2 seen actions within the second, got %d", len(cursor.seen))
+	}
+	next := testAction("640000010000000000000000", 1200*time.Millisecond)
+	cursor.advance(next)
+	if len(cursor.seen) != 1 {
+		t.Fatalf("expected the seen actions of the previous second to be pruned, got %d", len(cursor.seen))
+	}
+	if _, exist := cursor.seen[next.ID]; !exist {
+		t.Error("expected the latest action to be kept as seen")
+	}
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/adlio/trello"
+)
+
+// TrelloBatchHandler handles a batch of actions, the batch is retried when the
+// handler fails.
+type TrelloBatchHandler func(ctx *TrelloEventCtx, actions []*trello.Action) error
+
+// CursorCommitter persists the cursor of a listener once every action up to
+// the cursor was delivered.
+type CursorCommitter func(ctx *TrelloEventCtx, lastActionId string)
+
+type pendingBatch struct {
+	ctx     *TrelloEventCtx
+	actions []*trello.Action
+	timer   *time.Timer
+}
+
+// EventCoalescer sits between the hub and the delivery queue of a subscriber
+// and groups the actions made on the same card by the same member within a
+// window, so a burst of edits is delivered as one batch. Actions not made on a
+// card are queued right away as a batch of one.
+type EventCoalescer struct {
+	window  time.Duration
+	queue   *DeliveryQueue
+	pending map[string]*pendingBatch
+	// dispatched is the last action received for each board, and
+	// pendingCount the number of batches of the board not queued yet
+	dispatched   map[string]string
+	pendingCount map[string]int
+	mtx          sync.Mutex
+}
+
+// enqueue queues an item, along with the board cursor when no other batch of
+// the board is pending: every action received so far is then queued. It is
+// called with the lock held so items are queued in the order they leave the
+// pending set.
+func (c *EventCoalescer) enqueue(item *deliveryItem) {
+	if c.pendingCount[item.ctx.IdModel] == 0 {
+		item.cursor = c.dispatched[item.ctx.IdModel]
+	}
+	c.queue.push(item)
+}
+
+// Handle is the TrelloEventHandler registered to the hub.
+func (c *EventCoalescer) Handle(ctx *TrelloEventCtx, action *trello.Action) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.dispatched[ctx.IdModel] = action.ID
+	if c.window <= 0 || action.Data == nil || action.Data.Card == nil {
+		c.enqueue(&deliveryItem{ctx: ctx, actions: []*trello.Action{action}})
+		return
+	}
+	key := action.Data.Card.ID + "/" + action.IDMemberCreator
+	if batch, exist := c.pending[key]; exist {
+		batch.actions = append(batch.actions, action)
+		return
+	}
+	batch := &pendingBatch{ctx: ctx, actions: []*trello.Action{action}}
+	batch.timer = time.AfterFunc(c.window, func() { c.flush(key) })
+	c.pending[key] = batch
+	c.pendingCount[ctx.IdModel]++
+}
+
+func (c *EventCoalescer) flush(key string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if batch, exist := c.pending[key]; exist {
+		delete(c.pending, key)
+		c.pendingCount[batch.ctx.IdModel]--
+		c.enqueue(&deliveryItem{ctx: batch.ctx, actions: batch.actions})
+	}
+}
+
+// Flush queues the pending batches right away, it is called on shutdown so
+// the queue delivers them before stopping.
+func (c *EventCoalescer) Flush() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for key, batch := range c.pending {
+		batch.timer.Stop()
+		delete(c.pending, key)
+		c.pendingCount[batch.ctx.IdModel]--
+		c.enqueue(&deliveryItem{ctx: batch.ctx, actions: batch.actions})
+	}
+}
+
+// HandleGap is the TrelloGapHandler registered to the hub, the gap is queued
+// right away.
+func (c *EventCoalescer) HandleGap(ctx *TrelloEventCtx, gap *TrelloGap) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.dispatched[ctx.IdModel] = gap.LastActionId
+	c.enqueue(&deliveryItem{ctx: ctx, gap: gap})
+}
+
+func NewEventCoalescer(window time.Duration, queue *DeliveryQueue) *EventCoalescer {
+	return &EventCoalescer{
+		window:       window,
+		queue:        queue,
+		pending:      make(map[string]*pendingBatch),
+		dispatched:   make(map[string]string),
+		pendingCount: make(map[string]int),
+	}
+}
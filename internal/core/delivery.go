@@ -0,0 +1,200 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/adlio/trello"
+	"github.com/bwmarrin/discordgo"
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	maxDeliveryAttempts = 10
+	initialRetryDelay   = time.Second
+	maxRetryDelay       = 5 * time.Minute
+)
+
+// DeadLetterHandler receives the batches that could not be delivered, along
+// with the last delivery error.
+type DeadLetterHandler func(ctx *TrelloEventCtx, actions []*trello.Action, err error)
+
+// GapNotifier notifies a subscriber of the actions it missed, it is retried
+// like a batch when it fails.
+type GapNotifier func(ctx *TrelloEventCtx, gap *TrelloGap) error
+
+// deliveryItem is either a batch of actions or a gap summary.
+type deliveryItem struct {
+	ctx     *TrelloEventCtx
+	actions []*trello.Action
+	gap     *TrelloGap
+	// cursor is committed once the item is handled, it is empty when other
+	// actions received before it are still waiting to be queued
+	cursor string
+}
+
+// DeliveryQueue delivers the batches of a subscriber one at a time and in
+// order, retrying the failed deliveries with an exponential backoff. A batch
+// failing with a permanent error or after maxDeliveryAttempts attempts is
+// dead-lettered. The cursor attached to a batch is committed once the batch
+// is delivered or dead-lettered, so an event is never skipped by the cursor
+// while it is still being retried.
+type DeliveryQueue struct {
+	handler    TrelloBatchHandler
+	notifyGap  GapNotifier
+	commit     CursorCommitter
+	deadLetter DeadLetterHandler
+	items      []*deliveryItem
+	draining   bool
+	wake       chan struct{}
+	stop       chan struct{}
+	stopped    chan struct{}
+	mtx        sync.Mutex
+}
+
+func (q *DeliveryQueue) push(item *deliveryItem) {
+	q.mtx.Lock()
+	q.items = append(q.items, item)
+	q.mtx.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for the next item, it returns false once the queue is stopped or
+// drained.
+func (q *DeliveryQueue) next() (*deliveryItem, bool) {
+	for {
+		q.mtx.Lock()
+		if len(q.items) > 0 {
+			item := q.items[0]
+			q.items = q.items[1:]
+			q.mtx.Unlock()
+			return item, true
+		}
+		draining := q.draining
+		q.mtx.Unlock()
+		if draining {
+			return nil, false
+		}
+		select {
+		case <-q.wake:
+		case <-q.stop:
+			return nil, false
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying a delivery, the delay
+// asked by a rate limit response has priority over the backoff delay.
+func retryDelay(err error, backoff time.Duration) time.Duration {
+	var rateLimitErr discordgo.RateLimitError
+	if errors.As(err, &rateLimitErr) && rateLimitErr.RateLimit != nil && rateLimitErr.TooManyRequests != nil {
+		return rateLimitErr.RetryAfter
+	}
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusTooManyRequests {
+		if delay, ok := parseRetryAfter(restErr.Response.Header.Get("Retry-After")); ok {
+			return delay
+		}
+	}
+	return backoff
+}
+
+// isPermanentError reports the errors a retry can not fix, such as a missing
+// permission or a deleted channel or card.
+func isPermanentError(err error) bool {
+	if trello.IsNotFound(err) || trello.IsPermissionDenied(err) {
+		return true
+	}
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil {
+		code := restErr.Response.StatusCode
+		return code >= 400 && code < 500 && code != http.StatusTooManyRequests
+	}
+	return false
+}
+
+func (q *DeliveryQueue) deliver(item *deliveryItem) {
+	backoff := initialRetryDelay
+	for attempt := 1; ; attempt++ {
+		var err error
+		if item.gap != nil {
+			err = q.notifyGap(item.ctx, item.gap)
+		} else {
+			err = q.handler(item.ctx, item.actions)
+		}
+		if err == nil {
+			break
+		}
+		if isPermanentError(err) || attempt == maxDeliveryAttempts {
+			log.Error("Could not deliver board events, dead-lettering them", "boardId", item.ctx.IdModel, "count", len(item.actions), "attempts", attempt, "error", err)
+			if q.deadLetter != nil {
+				q.deadLetter(item.ctx, item.actions, err)
+			}
+			break
+		}
+		delay := retryDelay(err, backoff)
+		log.Warn("Could not deliver board events, retrying", "boardId", item.ctx.IdModel, "count", len(item.actions), "attempt", attempt, "retryIn", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-q.stop:
+			// Not committed, the events are delivered again after a restart
+			return
+		}
+		if backoff *= 2; backoff > maxRetryDelay {
+			backoff = maxRetryDelay
+		}
+	}
+	if item.cursor != "" && q.commit != nil {
+		q.commit(item.ctx, item.cursor)
+	}
+}
+
+func (q *DeliveryQueue) run() {
+	defer close(q.stopped)
+	for {
+		item, ok := q.next()
+		if !ok {
+			return
+		}
+		q.deliver(item)
+	}
+}
+
+// Close delivers the queued batches until the queue is empty or the context
+// is done, the batches left are not committed and are delivered again after a
+// restart.
+func (q *DeliveryQueue) Close(ctx context.Context) {
+	q.mtx.Lock()
+	q.draining = true
+	q.mtx.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	select {
+	case <-q.stopped:
+	case <-ctx.Done():
+		close(q.stop)
+		<-q.stopped
+	}
+}
+
+func NewDeliveryQueue(handler TrelloBatchHandler, notifyGap GapNotifier, commit CursorCommitter, deadLetter DeadLetterHandler) *DeliveryQueue {
+	q := &DeliveryQueue{
+		handler:    handler,
+		notifyGap:  notifyGap,
+		commit:     commit,
+		deadLetter: deadLetter,
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
@@ -0,0 +1,191 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adlio/trello"
+	"github.com/bwmarrin/discordgo"
+)
+
+// deliveryRecorder records the calls of the delivery queue callbacks.
+type deliveryRecorder struct {
+	attempts    int
+	delivered   [][]*trello.Action
+	commits     []string
+	deadLetters [][]*trello.Action
+	committed   chan string
+	mtx         sync.Mutex
+}
+
+func newDeliveryRecorder() *deliveryRecorder {
+	return &deliveryRecorder{committed: make(chan string, 10)}
+}
+
+func (r *deliveryRecorder) commit(ctx *TrelloEventCtx, lastActionId string) {
+	r.mtx.Lock()
+	r.commits = append(r.commits, lastActionId)
+	r.mtx.Unlock()
+	r.committed <- lastActionId
+}
+
+func (r *deliveryRecorder) deadLetter(ctx *TrelloEventCtx, actions []*trello.Action, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.deadLetters = append(r.deadLetters, actions)
+}
+
+func (r *deliveryRecorder) waitCommit(t *testing.T) string {
+	select {
+	case cursor := <-r.committed:
+		return cursor
+	case <-time.After(time.Second):
+		t.Fatal("expected a cursor to be committed")
+		return ""
+	}
+}
+
+func rateLimited(retryAfter time.Duration) error {
+	return discordgo.RateLimitError{RateLimit: &discordgo.RateLimit{
+		TooManyRequests: &discordgo.TooManyRequests{RetryAfter: retryAfter},
+	}}
+}
+
+func cardAction(id string, cardId string) *trello.Action {
+	return &trello.Action{
+		ID:              id,
+		Type:            EventUpdateCard,
+		IDMemberCreator: "member",
+		Data:            &trello.ActionData{Card: &trello.ActionDataCard{ID: cardId}},
+	}
+}
+
+func TestDeliveryQueueRetriesFailedBatch(t *testing.T) {
+	recorder := newDeliveryRecorder()
+	handler := func(ctx *TrelloEventCtx, actions []*trello.Action) error {
+		recorder.mtx.Lock()
+		defer recorder.mtx.Unlock()
+		recorder.attempts++
+		if recorder.attempts == 1 {
+			return rateLimited(10 * time.Millisecond)
+		}
+		recorder.delivered = append(recorder.delivered, actions)
+		return nil
+	}
+	queue := NewDeliveryQueue(handler, nil, recorder.commit, recorder.deadLetter)
+	defer queue.Close(context.Background())
+	action := cardAction("action", "card")
+	queue.push(&deliveryItem{ctx: &TrelloEventCtx{IdModel: "board"}, actions: []*trello.Action{action}, cursor: action.ID})
+
+	if cursor := recorder.waitCommit(t); cursor != action.ID {
+		t.Errorf("expected cursor %s to be committed, got %s", action.ID, cursor)
+	}
+	recorder.mtx.Lock()
+	defer recorder.mtx.Unlock()
+	if recorder.attempts != 2 || len(recorder.delivered) != 1 {
+		t.Errorf("expected the batch to be delivered on the second attempt, got %d attempts and %d deliveries", recorder.attempts, len(recorder.delivered))
+	}
+	if len(recorder.deadLetters) != 0 {
+		t.Errorf("expected no dead letter, got %d", len(recorder.deadLetters))
+	}
+}
+
+func TestDeliveryQueueDeadLettersPermanentError(t *testing.T) {
+	recorder := newDeliveryRecorder()
+	forbidden := &discordgo.RESTError{Response: &http.Response{StatusCode: http.StatusForbidden, Status: "403 Forbidden"}}
+	handler := func(ctx *TrelloEventCtx, actions []*trello.Action) error {
+		recorder.mtx.Lock()
+		defer recorder.mtx.Unlock()
+		recorder.attempts++
+		return forbidden
+	}
+	queue := NewDeliveryQueue(handler, nil, recorder.commit, recorder.deadLetter)
+	defer queue.Close(context.Background())
+	action := cardAction("action", "card")
+	queue.push(&deliveryItem{ctx: &TrelloEventCtx{IdModel: "board"}, actions: []*trello.Action{action}, cursor: action.ID})
+
+	// The cursor moves past the dead letter
+	if cursor := recorder.waitCommit(t); cursor != action.ID {
+		t.Errorf("expected cursor %s to be committed, got %s", action.ID, cursor)
+	}
+	recorder.mtx.Lock()
+	defer recorder.mtx.Unlock()
+	if recorder.attempts != 1 {
+		t.Errorf("expected a permanent error not to be retried, got %d attempts", recorder.attempts)
+	}
+	if len(recorder.deadLetters) != 1 || recorder.deadLetters[0][0] != action {
+		t.Errorf("expected the batch to be dead-lettered, got %v", recorder.deadLetters)
+	}
+}
+
+func TestEventCoalescerHoldsCursorWhileBatchPending(t *testing.T) {
+	recorder := newDeliveryRecorder()
+	delivered := make(chan []*trello.Action, 10)
+	handler := func(ctx *TrelloEventCtx, actions []*trello.Action) error {
+		delivered <- actions
+		return nil
+	}
+	queue := NewDeliveryQueue(handler, nil, recorder.commit, recorder.deadLetter)
+	defer queue.Close(context.Background())
+	coalescer := NewEventCoalescer(time.Hour, queue)
+	ctx := &TrelloEventCtx{IdModel: "board"}
+
+	edit := cardAction("edit", "card")
+	boardAction := &trello.Action{ID: "board action", Type: EventAddMemberToBoard}
+	coalescer.Handle(ctx, edit)
+	coalescer.Handle(ctx, boardAction)
+	select {
+	case actions := <-delivered:
+		if actions[0] != boardAction {
+			t.Fatalf("expected the board action to be delivered first, got %s", actions[0].ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the board action to be delivered right away")
+	}
+	select {
+	case cursor := <-recorder.committed:
+		t.Fatalf("expected no cursor while the card batch is pending, got %s", cursor)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The card batch carries the cursor of every action received
+	coalescer.Flush()
+	if cursor := recorder.waitCommit(t); cursor != boardAction.ID {
+		t.Errorf("expected cursor %s once the card batch is delivered, got %s", boardAction.ID, cursor)
+	}
+}
+
+func TestDeliveryQueueCloseCancelledDoesNotCommit(t *testing.T) {
+	recorder := newDeliveryRecorder()
+	attempted := make(chan struct{}, 10)
+	handler := func(ctx *TrelloEventCtx, actions []*trello.Action) error {
+		attempted <- struct{}{}
+		return errors.New("discord unavailable")
+	}
+	queue := NewDeliveryQueue(handler, nil, recorder.commit, recorder.deadLetter)
+	ctx := &TrelloEventCtx{IdModel: "board"}
+	first, second := cardAction("first", "card"), cardAction("second", "card")
+	queue.push(&deliveryItem{ctx: ctx, actions: []*trello.Action{first}, cursor: first.ID})
+	queue.push(&deliveryItem{ctx: ctx, actions: []*trello.Action{second}, cursor: second.ID})
+	select {
+	case <-attempted:
+	case <-time.After(time.Second):
+		t.Fatal("expected the first batch to be attempted")
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	queue.Close(cancelled)
+	recorder.mtx.Lock()
+	defer recorder.mtx.Unlock()
+	if len(recorder.commits) != 0 {
+		t.Errorf("expected nothing to be committed, got %v", recorder.commits)
+	}
+	if len(recorder.deadLetters) != 0 {
+		t.Errorf("expected no dead letter, got %d", len(recorder.deadLetters))
+	}
+}
@@ -19,6 +19,7 @@ type DiscordBot struct {
 	Session       *discordgo.Session
 	CmdRouter     *dgc.Router
 	cmdProcessors []CommandProcessor
+	slashCommands map[string]*slashCommand
 }
 
 func (bot *DiscordBot) RegisterCommand(cmds ...*dgc.Command) {
@@ -42,6 +43,8 @@ func (bot *DiscordBot) Run(ctx context.Context) {
 	}
 	bot.CmdRouter.RegisterDefaultHelpCommand(bot.Session, nil)
 	bot.CmdRouter.Initialize(bot.Session)
+	bot.registerSlashCommands()
+	bot.Session.AddHandler(bot.onInteractionCreate)
 
 	for _, processor := range bot.cmdProcessors {
 		err := processor.OnStartBot(bot.Session)
@@ -70,7 +73,8 @@ func NewDiscordBot(botToken string, cmdPrefix string) (*DiscordBot, error) {
 		Storage:  make(map[string]*dgc.ObjectsMap),
 	}
 	return &DiscordBot{
-		Session:   botSession,
-		CmdRouter: cmdRouter,
+		Session:       botSession,
+		CmdRouter:     cmdRouter,
+		slashCommands: make(map[string]*slashCommand),
 	}, nil
 }
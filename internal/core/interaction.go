@@ -0,0 +1,349 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/inconshreveable/log15"
+	"github.com/lus/dgc"
+)
+
+// SlashCommandProcessor is implemented by processors that also expose their
+// prefix commands as application commands. A slash command (or subcommand) is
+// executed by the prefix command of the same name, its options are passed as
+// the command arguments in the declared order. Subcommand groups map to the
+// subcommands of a prefix command.
+type SlashCommandProcessor interface {
+	CommandProcessor
+	ApplicationCommands() []*discordgo.ApplicationCommand
+	ContextMenuCommands() []*ContextMenuCommand
+	Autocomplete(interaction *discordgo.Interaction, cmdName string, option *discordgo.ApplicationCommandInteractionDataOption) []*discordgo.ApplicationCommandOptionChoice
+}
+
+// ContextMenuCommand binds a message or user context menu command to the
+// prefix command executed with the id of the target message or user as its
+// only argument.
+type ContextMenuCommand struct {
+	*discordgo.ApplicationCommand
+	CmdPath []string
+}
+
+// ComponentProcessor is implemented by processors sending messages with
+// components. Component interactions are routed to the processor whose prefix
+// followed by a colon starts the custom id of the component.
+type ComponentProcessor interface {
+	CommandProcessor
+	ComponentPrefix() string
+	HandleComponent(session *discordgo.Session, interaction *discordgo.Interaction)
+}
+
+type slashCommand struct {
+	*discordgo.ApplicationCommand
+	processor SlashCommandProcessor
+	cmdPath   []string
+}
+
+// slashInteraction is an application command interaction being executed by a
+// prefix command handler, the replies of the handler are sent as interaction
+// responses instead of channel messages.
+type slashInteraction struct {
+	session     *discordgo.Session
+	interaction *discordgo.Interaction
+	args        []string
+	responded   bool
+}
+
+// slashInteractions maps the id of the synthetic message passed to the prefix
+// command handler to the interaction it was created from.
+var slashInteractions sync.Map
+
+func (si *slashInteraction) respond(content string, embeds []*discordgo.MessageEmbed) error {
+	if embeds == nil {
+		embeds = []*discordgo.MessageEmbed{}
+	}
+	if !si.responded {
+		si.responded = true
+		_, err := si.session.InteractionResponseEdit(si.interaction, &discordgo.WebhookEdit{
+			Content: &content,
+			Embeds:  &embeds,
+		})
+		return err
+	}
+	_, err := si.session.FollowupMessageCreate(si.interaction, true, &discordgo.WebhookParams{
+		Content: content,
+		Embeds:  embeds,
+	})
+	return err
+}
+
+func getSlashInteraction(ctx *dgc.Ctx) (*slashInteraction, bool) {
+	val, ok := slashInteractions.Load(ctx.Event.ID)
+	if !ok {
+		return nil, false
+	}
+	return val.(*slashInteraction), true
+}
+
+// CommandArguments are the arguments of a prefix or slash command.
+type CommandArguments []string
+
+// Get returns the n'th argument, or an empty string if there are fewer.
+func (args CommandArguments) Get(n int) string {
+	if n < len(args) {
+		return args[n]
+	}
+	return ""
+}
+
+// Arguments returns the arguments of a command, command handlers use it
+// instead of ctx.Arguments. The options of a slash command are passed as
+// given, the prefix command syntax has no way to quote values containing
+// quotes.
+func Arguments(ctx *dgc.Ctx) CommandArguments {
+	if si, ok := getSlashInteraction(ctx); ok {
+		return si.args
+	}
+	args := make(CommandArguments, ctx.Arguments.Amount())
+	for idx := range args {
+		args[idx] = ctx.Arguments.Get(idx).Raw()
+	}
+	return args
+}
+
+// RespondText replies to a command with a text message, command handlers use
+// it instead of ctx.RespondText so they work for both prefix and slash commands.
+func RespondText(ctx *dgc.Ctx, text string) error {
+	if si, ok := getSlashInteraction(ctx); ok {
+		return si.respond(text, nil)
+	}
+	return ctx.RespondText(text)
+}
+
+// RespondEmbed replies to a command with an embed message.
+func RespondEmbed(ctx *dgc.Ctx, embed *discordgo.MessageEmbed) error {
+	if si, ok := getSlashInteraction(ctx); ok {
+		return si.respond("", []*discordgo.MessageEmbed{embed})
+	}
+	return ctx.RespondEmbed(embed)
+}
+
+func formatSlashOption(option *discordgo.ApplicationCommandInteractionDataOption) string {
+	switch option.Type {
+	case discordgo.ApplicationCommandOptionUser:
+		return fmt.Sprintf("<@%s>", option.Value)
+	case discordgo.ApplicationCommandOptionChannel:
+		return fmt.Sprintf("<#%s>", option.Value)
+	case discordgo.ApplicationCommandOptionRole:
+		return fmt.Sprintf("<@&%s>", option.Value)
+	case discordgo.ApplicationCommandOptionString:
+		return option.StringValue()
+	}
+	return fmt.Sprint(option.Value)
+}
+
+// slashArguments returns the given options as prefix command arguments in the
+// declared order, missing optional options are passed as empty arguments.
+func slashArguments(declared []*discordgo.ApplicationCommandOption, given []*discordgo.ApplicationCommandInteractionDataOption) []string {
+	values := map[string]*discordgo.ApplicationCommandInteractionDataOption{}
+	for _, option := range given {
+		values[option.Name] = option
+	}
+	args := []string{}
+	for _, option := range declared {
+		if value, ok := values[option.Name]; ok {
+			args = append(args, formatSlashOption(value))
+		} else {
+			args = append(args, "")
+		}
+	}
+	for len(args) > 0 && args[len(args)-1] == "" {
+		args = args[:len(args)-1]
+	}
+	return args
+}
+
+// resolveSlashCommand returns the command path, declared options and given
+// options of the invoked command, descending into subcommand groups and
+// subcommands. A path like [card create] is executed by the create subcommand
+// of the card prefix command.
+func (bot *DiscordBot) resolveSlashCommand(data discordgo.ApplicationCommandInteractionData) (*slashCommand, []string, []*discordgo.ApplicationCommandOption, []*discordgo.ApplicationCommandInteractionDataOption) {
+	cmd, exist := bot.slashCommands[data.Name]
+	if !exist {
+		return nil, nil, nil, nil
+	}
+	if len(cmd.cmdPath) > 0 {
+		return cmd, cmd.cmdPath, nil, nil
+	}
+	path := []string{}
+	declared, given := cmd.Options, data.Options
+	for len(given) == 1 && (given[0].Type == discordgo.ApplicationCommandOptionSubCommand || given[0].Type == discordgo.ApplicationCommandOptionSubCommandGroup) {
+		sub := given[0]
+		var found *discordgo.ApplicationCommandOption
+		for _, option := range declared {
+			if option.Name == sub.Name {
+				found = option
+				break
+			}
+		}
+		if found == nil {
+			return nil, nil, nil, nil
+		}
+		path = append(path, sub.Name)
+		declared, given = found.Options, sub.Options
+	}
+	if len(path) == 0 {
+		path = []string{data.Name}
+	}
+	return cmd, path, declared, given
+}
+
+func (bot *DiscordBot) findCommand(path []string) *dgc.Command {
+	cmd := bot.CmdRouter.GetCmd(path[0])
+	for _, name := range path[1:] {
+		if cmd == nil {
+			return nil
+		}
+		cmd = cmd.GetSubCmd(name)
+	}
+	return cmd
+}
+
+func (bot *DiscordBot) executeSlashCommand(session *discordgo.Session, interaction *discordgo.Interaction) {
+	if interaction.Member == nil {
+		session.InteractionRespond(interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "This command is only available in servers.",
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		return
+	}
+	slashCmd, path, declared, given := bot.resolveSlashCommand(interaction.ApplicationCommandData())
+	var cmd *dgc.Command
+	if slashCmd != nil {
+		cmd = bot.findCommand(path)
+	}
+	if cmd == nil {
+		log.Warn("Received unknown slash command", "name", interaction.ApplicationCommandData().Name)
+		return
+	}
+	name := strings.Join(path, " ")
+	// Acknowledge right away, the handler may take longer than the 3 seconds
+	// Discord waits for the initial response.
+	err := session.InteractionRespond(interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if err != nil {
+		log.Error("Could not acknowledge slash command", "name", name, "error", err)
+		return
+	}
+	args := slashArguments(declared, given)
+	if len(slashCmd.cmdPath) > 0 {
+		args = []string{interaction.ApplicationCommandData().TargetID}
+	}
+	// The message content is only informative, the handlers read the
+	// arguments with Arguments
+	content := strings.TrimSpace(name + " " + strings.Join(args, " "))
+	ctx := &dgc.Ctx{
+		Session: session,
+		Event: &discordgo.MessageCreate{
+			Message: &discordgo.Message{
+				ID:        interaction.ID,
+				ChannelID: interaction.ChannelID,
+				GuildID:   interaction.GuildID,
+				Author:    interaction.Member.User,
+				Member:    interaction.Member,
+				Content:   content,
+			},
+		},
+		Arguments: dgc.ParseArguments(strings.Join(args, " ")),
+		Router:    bot.CmdRouter,
+		Command:   cmd,
+	}
+	si := &slashInteraction{session: session, interaction: interaction, args: args}
+	slashInteractions.Store(interaction.ID, si)
+	defer slashInteractions.Delete(interaction.ID)
+
+	handler := cmd.Handler
+	for _, middleware := range bot.CmdRouter.Middlewares {
+		handler = middleware(handler)
+	}
+	handler(ctx)
+	if !si.responded {
+		session.InteractionResponseDelete(interaction)
+	}
+}
+
+func (bot *DiscordBot) autocompleteSlashCommand(session *discordgo.Session, interaction *discordgo.Interaction) {
+	slashCmd, path, _, given := bot.resolveSlashCommand(interaction.ApplicationCommandData())
+	if slashCmd == nil {
+		return
+	}
+	name := strings.Join(path, " ")
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	for _, option := range given {
+		if option.Focused {
+			choices = slashCmd.processor.Autocomplete(interaction, name, option)
+			break
+		}
+	}
+	err := session.InteractionRespond(interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+	if err != nil {
+		log.Error("Could not respond autocomplete choices", "name", name, "error", err)
+	}
+}
+
+func (bot *DiscordBot) handleComponent(session *discordgo.Session, interaction *discordgo.Interaction) {
+	customId := interaction.MessageComponentData().CustomID
+	for _, processor := range bot.cmdProcessors {
+		componentProcessor, ok := processor.(ComponentProcessor)
+		if ok && strings.HasPrefix(customId, componentProcessor.ComponentPrefix()+":") {
+			componentProcessor.HandleComponent(session, interaction)
+			return
+		}
+	}
+	log.Warn("Received unknown component interaction", "customId", customId)
+}
+
+func (bot *DiscordBot) onInteractionCreate(session *discordgo.Session, event *discordgo.InteractionCreate) {
+	switch event.Type {
+	case discordgo.InteractionApplicationCommand:
+		bot.executeSlashCommand(session, event.Interaction)
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		bot.autocompleteSlashCommand(session, event.Interaction)
+	case discordgo.InteractionMessageComponent:
+		bot.handleComponent(session, event.Interaction)
+	}
+}
+
+func (bot *DiscordBot) registerSlashCommands() {
+	appCmds := []*discordgo.ApplicationCommand{}
+	for _, processor := range bot.cmdProcessors {
+		slashProcessor, ok := processor.(SlashCommandProcessor)
+		if !ok {
+			continue
+		}
+		for _, appCmd := range slashProcessor.ApplicationCommands() {
+			bot.slashCommands[appCmd.Name] = &slashCommand{appCmd, slashProcessor, nil}
+			appCmds = append(appCmds, appCmd)
+		}
+		for _, menuCmd := range slashProcessor.ContextMenuCommands() {
+			bot.slashCommands[menuCmd.Name] = &slashCommand{menuCmd.ApplicationCommand, slashProcessor, menuCmd.CmdPath}
+			appCmds = append(appCmds, menuCmd.ApplicationCommand)
+		}
+	}
+	if len(appCmds) == 0 {
+		return
+	}
+	if _, err := bot.Session.ApplicationCommandBulkOverwrite(bot.Session.State.User.ID, "", appCmds); err != nil {
+		log.Error("Could not register slash commands", "error", err)
+	}
+}
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/lus/dgc"
+)
+
+func TestSlashArguments(t *testing.T) {
+	declared := []*discordgo.ApplicationCommandOption{
+		{Type: discordgo.ApplicationCommandOptionString, Name: "list"},
+		{Type: discordgo.ApplicationCommandOptionString, Name: "title"},
+		{Type: discordgo.ApplicationCommandOptionString, Name: "description"},
+		{Type: discordgo.ApplicationCommandOptionUser, Name: "assignee"},
+	}
+	given := []*discordgo.ApplicationCommandInteractionDataOption{
+		{Type: discordgo.ApplicationCommandOptionUser, Name: "assignee", Value: "42"},
+		{Type: discordgo.ApplicationCommandOptionString, Name: "title", Value: `Fix "login" page`},
+		{Type: discordgo.ApplicationCommandOptionString, Name: "list", Value: "To Do"},
+	}
+	args := slashArguments(declared, given)
+	ctx := &dgc.Ctx{Event: &discordgo.MessageCreate{Message: &discordgo.Message{ID: "interaction"}}}
+	slashInteractions.Store("interaction", &slashInteraction{args: args})
+	defer slashInteractions.Delete("interaction")
+
+	want := []string{"To Do", `Fix "login" page`, "", "<@42>"}
+	got := Arguments(ctx)
+	if len(got) != len(want) {
+		t.Fatalf("expected %d arguments, got %q", len(want), got)
+	}
+	for idx := range want {
+		if got.Get(idx) != want[idx] {
+			t.Errorf("argument %d is %q, want %q", idx, got.Get(idx), want[idx])
+		}
+	}
+	if got.Get(len(want)) != "" {
+		t.Errorf("expected an empty argument past the given ones, got %q", got.Get(len(want)))
+	}
+}
+
+func TestPrefixArguments(t *testing.T) {
+	ctx := &dgc.Ctx{
+		Event:     &discordgo.MessageCreate{Message: &discordgo.Message{ID: "message"}},
+		Arguments: dgc.ParseArguments(`"To Do" title`),
+	}
+	got := Arguments(ctx)
+	if len(got) != 2 || got.Get(0) != "To Do" || got.Get(1) != "title" {
+		t.Errorf("expected the parsed prefix arguments, got %q", got)
+	}
+}
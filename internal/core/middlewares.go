@@ -24,6 +24,6 @@ func restrictRolesMiddleware(next dgc.ExecutionHandler) dgc.ExecutionHandler {
 			next(ctx)
 			return
 		}
-		ctx.RespondText("You do not have permission to perform this action.")
+		RespondText(ctx, "You do not have permission to perform this action.")
 	}
 }
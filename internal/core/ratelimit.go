@@ -0,0 +1,99 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/adlio/trello"
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Trello allows 100 requests per 10 seconds for a token, the limit is
+	// kept a little below so the other clients of the token get some room.
+	trelloRequestsPerSecond = 9
+	trelloRequestBurst      = 10
+	// trelloRateLimitPause is how long requests are paused after a 429
+	// response without a Retry-After header, it is the Trello limit window.
+	trelloRateLimitPause = 10 * time.Second
+	trelloRequestTimeout = 30 * time.Second
+)
+
+// parseRetryAfter reads a Retry-After header given in seconds.
+func parseRetryAfter(header string) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// rateLimitedTransport makes every request of the Trello client take a token
+// from a shared bucket, so the pollers and the commands together stay within
+// the rate limit of the token. A 429 response pauses all requests until the
+// limit is lifted.
+type rateLimitedTransport struct {
+	base        http.RoundTripper
+	limiter     *rate.Limiter
+	pausedUntil time.Time
+	mtx         sync.Mutex
+}
+
+func (t *rateLimitedTransport) wait(ctx context.Context) error {
+	t.mtx.Lock()
+	pause := time.Until(t.pausedUntil)
+	t.mtx.Unlock()
+	if pause > 0 {
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return t.limiter.Wait(ctx)
+}
+
+func (t *rateLimitedTransport) pause(delay time.Duration) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if until := time.Now().Add(delay); until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+		if !ok {
+			delay = trelloRateLimitPause
+		}
+		log.Warn("Trello rate limit reached, pausing requests", "path", req.URL.Path, "pause", delay)
+		t.pause(delay)
+	}
+	return resp, err
+}
+
+// limitTrelloClient routes the requests of a Trello client through a shared
+// rate limiter, the http client is replaced rather than modified as it is
+// http.DefaultClient by default.
+func limitTrelloClient(client *trello.Client) {
+	base := http.DefaultTransport
+	if client.Client != nil && client.Client.Transport != nil {
+		base = client.Client.Transport
+	}
+	client.Client = &http.Client{
+		Transport: &rateLimitedTransport{
+			base:    base,
+			limiter: rate.NewLimiter(trelloRequestsPerSecond, trelloRequestBurst),
+		},
+		Timeout: trelloRequestTimeout,
+	}
+}
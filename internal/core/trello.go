@@ -3,7 +3,10 @@ package core
 import (
 	"context"
 	"errors"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/inconshreveable/log15"
@@ -12,22 +15,84 @@ import (
 )
 
 const (
-	EventCreateCard       = "createCard"
-	EventCopyCard         = "copyCard"
-	EventCommentCard      = "commentCard"
-	EventDeleteCard       = "deleteCard"
-	EventUpdateCard       = "updateCard"
-	EventAddMemberToBoard = "addMemberToBoard"
-	EventAddMemberToCard  = "addMemberToCard"
+	EventCreateCard                 = "createCard"
+	EventCopyCard                   = "copyCard"
+	EventCommentCard                = "commentCard"
+	EventDeleteCard                 = "deleteCard"
+	EventUpdateCard                 = "updateCard"
+	EventAddMemberToBoard           = "addMemberToBoard"
+	EventAddMemberToCard            = "addMemberToCard"
+	EventRemoveMemberFromBoard      = "removeMemberFromBoard"
+	EventRemoveMemberFromCard       = "removeMemberFromCard"
+	EventAddChecklistToCard         = "addChecklistToCard"
+	EventCreateCheckItem            = "createCheckItem"
+	EventDeleteCheckItem            = "deleteCheckItem"
+	EventUpdateCheckItemStateOnCard = "updateCheckItemStateOnCard"
+	EventAddLabelToCard             = "addLabelToCard"
+	EventRemoveLabelFromCard        = "removeLabelFromCard"
+	EventAddAttachmentToCard        = "addAttachmentToCard"
+	EventDeleteAttachmentFromCard   = "deleteAttachmentFromCard"
+)
+
+var (
+	// TrelloEvents lists the event types a listener can enable.
+	TrelloEvents = []string{
+		EventCreateCard,
+		EventCopyCard,
+		EventCommentCard,
+		EventDeleteCard,
+		EventUpdateCard,
+		EventAddMemberToBoard,
+		EventAddMemberToCard,
+		EventRemoveMemberFromBoard,
+		EventRemoveMemberFromCard,
+		EventAddChecklistToCard,
+		EventCreateCheckItem,
+		EventDeleteCheckItem,
+		EventUpdateCheckItemStateOnCard,
+		EventAddLabelToCard,
+		EventRemoveLabelFromCard,
+		EventAddAttachmentToCard,
+		EventDeleteAttachmentFromCard,
+	}
+)
+
+const (
+	// maxPollWorkers bounds the number of boards fetched at the same time
+	maxPollWorkers = 4
+	// trelloActionPageSize is the number of actions fetched per request
+	// when catching up from a cursor, maxCatchUpPages bounds the requests
+	trelloActionPageSize = 200
+	maxCatchUpPages      = 10
+	// maxCatchUpActions is the number of missed actions above which a
+	// listener gets a gap summary instead of the actions
+	maxCatchUpActions = 100
+	// defaultMaxPollInterval is how far the polling of an idle board backs
+	// off when no maximum is set
+	defaultMaxPollInterval = 2 * time.Minute
 )
 
 var (
 	ErrAlreadySubscribe = errors.New("already subscribe")
 	ErrNoEventListener  = errors.New("event listener not found")
+	ErrBoardNotWatched  = errors.New("board not watched")
+	ErrNoWebhookSecret  = errors.New("webhook secret is required")
 )
 
 type TrelloEventHandler func(ctx *TrelloEventCtx, action *trello.Action)
 
+// TrelloGapHandler is called in place of the event handler when a listener
+// missed too many actions to deliver them.
+type TrelloGapHandler func(ctx *TrelloEventCtx, gap *TrelloGap)
+
+// TrelloGap summarizes the actions a listener missed. Truncated is set when
+// there were more actions than could be fetched, Missed is then a lower bound.
+type TrelloGap struct {
+	Missed       int
+	Truncated    bool
+	LastActionId string
+}
+
 type TrelloEventCtx struct {
 	Client        *trello.Client
 	IdModel       string
@@ -37,86 +102,505 @@ type TrelloEventCtx struct {
 
 type TrelloEventListener struct {
 	*TrelloEventCtx
-	Handler TrelloEventHandler
+	SubscriberId string
+	Handler      TrelloEventHandler
+	GapHandler   TrelloGapHandler
+	cursor       *actionCursor
+}
+
+// trelloBoard groups the listeners of a board so its actions are fetched
+// once and fanned out to every subscriber. Its fields are guarded by the hub
+// mutex.
+type trelloBoard struct {
+	idModel        string
+	listeners      map[string]*TrelloEventListener
+	webhook        *trello.Webhook
+	webhookRetryAt time.Time
+	// polling is set while the actions of the board are being fetched, a
+	// slow board is skipped by the next polls instead of piling them up
+	polling bool
+	// interval is the current polling interval of the board, it is reset to
+	// the minimum by new actions and doubled after each idle poll
+	interval time.Duration
+	nextPoll time.Time
+	// forcePoll makes the next poll fetch the board right away
+	forcePoll bool
+}
+
+// BoardPollStatus describes when a board is polled.
+type BoardPollStatus struct {
+	Interval time.Duration
+	NextPoll time.Time
+	// Webhook is set when the board events are pushed by a webhook, the
+	// board is then only polled on demand
+	Webhook bool
 }
 
+// enabledEvents returns the union of the events enabled by the board listeners.
+func (b *trelloBoard) enabledEvents() []string {
+	events := []string{}
+	for _, listener := range b.listeners {
+		for _, event := range listener.EnabledEvents {
+			if !containsString(events, event) {
+				events = append(events, event)
+			}
+		}
+	}
+	return events
+}
+
+// TrelloEventHub is safe for concurrent use, mtx guards the boards and their
+// listeners. It is held while dispatching so the handlers must not block, and
+// released around the Trello requests.
 type TrelloEventHub struct {
-	Client       *trello.Client
-	pollInterval time.Duration
-	listeners    map[string]*TrelloEventListener
+	Client *trello.Client
+	// pollInterval is the interval of the active boards, the idle ones back
+	// off up to maxPollInterval
+	pollInterval    time.Duration
+	maxPollInterval time.Duration
+	boards          map[string]*trelloBoard
+	webhook         *webhookReceiver
+	pollWorkers     chan struct{}
+	wake            chan struct{}
+	mtx             sync.Mutex
 }
 
 func (hub *TrelloEventHub) Listeners() []*TrelloEventListener {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
 	ret := make([]*TrelloEventListener, 0)
-	for _, listener := range hub.listeners {
-		ret = append(ret, listener)
+	for _, board := range hub.boards {
+		for _, listener := range board.listeners {
+			ret = append(ret, listener)
+		}
 	}
 	return ret
 }
 
-func (hub *TrelloEventHub) GetListener(idModel string) *TrelloEventListener {
-	return hub.listeners[idModel]
+func (hub *TrelloEventHub) GetListener(idModel string, subscriberId string) *TrelloEventListener {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+	return hub.listener(idModel, subscriberId)
 }
 
-func (hub *TrelloEventHub) Subscribe(idModel string, events []string, lastActionId string, handler TrelloEventHandler) (*TrelloEventListener, error) {
-	if listener, exist := hub.listeners[idModel]; exist {
+func (hub *TrelloEventHub) listener(idModel string, subscriberId string) *TrelloEventListener {
+	if board, exist := hub.boards[idModel]; exist {
+		return board.listeners[subscriberId]
+	}
+	return nil
+}
+
+// Subscribe registers a listener for the events of a board. A board can have
+// many subscribers, each with its own event filter and cursor. The gap handler
+// is optional, the missed actions are delivered when it is nil.
+func (hub *TrelloEventHub) Subscribe(idModel string, subscriberId string, events []string, lastActionId string, handler TrelloEventHandler, gapHandler TrelloGapHandler) (*TrelloEventListener, error) {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+	board, exist := hub.boards[idModel]
+	if !exist {
+		board = &trelloBoard{
+			idModel:   idModel,
+			listeners: map[string]*TrelloEventListener{},
+			interval:  hub.pollInterval,
+		}
+		hub.boards[idModel] = board
+	}
+	if listener, exist := board.listeners[subscriberId]; exist {
 		return listener, ErrAlreadySubscribe
 	}
-	hub.listeners[idModel] = &TrelloEventListener{
+	listener := &TrelloEventListener{
 		TrelloEventCtx: &TrelloEventCtx{
 			Client:        hub.Client,
 			IdModel:       idModel,
 			EnabledEvents: events,
 			LastActionId:  lastActionId,
 		},
-		Handler: handler,
+		SubscriberId: subscriberId,
+		Handler:      handler,
+		GapHandler:   gapHandler,
+		cursor:       newActionCursor(lastActionId),
+	}
+	if _, ok := ActionIdTime(lastActionId); !ok && lastActionId != "" {
+		log.Warn("Ignoring malformed cursor, the listener starts from the latest actions", "boardId", idModel, "subscriberId", subscriberId, "lastActionId", lastActionId)
+	}
+	board.listeners[subscriberId] = listener
+	return listener, nil
+}
+
+// Unsubscribe removes a listener of a board, the board stops being watched
+// once its last listener is removed.
+func (hub *TrelloEventHub) Unsubscribe(idModel string, subscriberId string) {
+	hub.mtx.Lock()
+	board, exist := hub.boards[idModel]
+	if !exist {
+		hub.mtx.Unlock()
+		return
+	}
+	delete(board.listeners, subscriberId)
+	if len(board.listeners) > 0 {
+		hub.mtx.Unlock()
+		return
+	}
+	delete(hub.boards, idModel)
+	webhook := board.webhook
+	hub.mtx.Unlock()
+	if webhook != nil {
+		if err := webhook.Delete(); err != nil {
+			log.Error("Could not delete board webhook", "boardId", idModel, "webhookId", webhook.ID, "err", err)
+		}
 	}
-	return hub.listeners[idModel], nil
 }
 
-func (hub *TrelloEventHub) Unsubscribe(idModel string) {
-	delete(hub.listeners, idModel)
+// EnabledEvents returns the event filter of a listener.
+func (hub *TrelloEventHub) EnabledEvents(idModel string, subscriberId string) ([]string, error) {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+	listener := hub.listener(idModel, subscriberId)
+	if listener == nil {
+		return nil, ErrNoEventListener
+	}
+	return listener.EnabledEvents, nil
 }
 
-func (hub *TrelloEventHub) pollEvents() {
-	for boardId, listener := range hub.listeners {
-		board := trello.Board{ID: boardId}
-		board.SetClient(hub.Client)
-		actions, err := board.GetActions(trello.Arguments{
-			"filter": strings.Join(listener.EnabledEvents, ","),
-		})
-		if err != nil {
-			log.Error("Could not fetch board events", "boardId", board.ID, "err", err)
+// SetEnabledEvents replaces the event filter of a listener.
+func (hub *TrelloEventHub) SetEnabledEvents(idModel string, subscriberId string, events []string) error {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+	listener := hub.listener(idModel, subscriberId)
+	if listener == nil {
+		return ErrNoEventListener
+	}
+	listener.EnabledEvents = events
+	return nil
+}
+
+func IsTrelloEvent(event string) bool {
+	return containsString(TrelloEvents, event)
+}
+
+// dispatch delivers an action pushed by a webhook to every listener of the
+// board that enabled its type and has not seen it yet. Both the poller and the
+// webhook receiver go through the listener cursors so an action is never
+// delivered twice.
+func (hub *TrelloEventHub) dispatch(board *trelloBoard, action *trello.Action) {
+	hub.dispatchActions(board, []*trello.Action{action}, false, false)
+}
+
+// dispatchActions dispatches the actions of a board, oldest first. It reports
+// whether any listener got new actions. Polled actions move the listener
+// cursors past every fetched action, pushed ones are only marked as seen as
+// the webhook may have skipped earlier actions.
+func (hub *TrelloEventHub) dispatchActions(board *trelloBoard, actions []*trello.Action, truncated bool, polled bool) bool {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+	dispatched := false
+	for _, listener := range board.listeners {
+		if hub.dispatchListener(board, listener, actions, truncated) {
+			dispatched = true
+		}
+		if !polled {
 			continue
 		}
+		// Move past the actions the listener filters out too, a listener
+		// with a narrow filter would otherwise hold back the since cursor of
+		// the board and every poll would fetch the same actions again
+		for _, action := range actions {
+			if !actionTime(action).Before(listener.cursor.time) {
+				listener.cursor.advance(action)
+			}
+		}
+	}
+	return dispatched
+}
 
-		for idx := len(actions) - 1; idx >= 0; idx-- {
-			action := actions[idx]
-			if action.ID > listener.LastActionId {
-				if listener.Handler != nil {
-					listener.Handler(listener.TrelloEventCtx, action)
-					listener.TrelloEventCtx.LastActionId = action.ID
-				}
+// dispatchListener delivers the new actions enabled by a listener. A listener
+// that missed more than maxCatchUpActions actions, or more than were fetched,
+// gets a gap summary instead of the actions. It is called with the lock held.
+func (hub *TrelloEventHub) dispatchListener(board *trelloBoard, listener *TrelloEventListener, actions []*trello.Action, truncated bool) bool {
+	if listener.Handler == nil {
+		return false
+	}
+	pending := []*trello.Action{}
+	for _, action := range actions {
+		if containsString(listener.EnabledEvents, action.Type) && listener.cursor.isNew(action) {
+			pending = append(pending, action)
+		}
+	}
+	if len(pending) == 0 {
+		return false
+	}
+	if !listener.cursor.time.IsZero() && listener.GapHandler != nil {
+		// The listener cursor is older than the fetched actions
+		missedMore := truncated && listener.cursor.time.Before(actionTime(actions[0]))
+		if missedMore || len(pending) > maxCatchUpActions {
+			gap := &TrelloGap{
+				Missed:       len(pending),
+				Truncated:    missedMore,
+				LastActionId: pending[len(pending)-1].ID,
+			}
+			log.Warn("Listener missed board events", "boardId", board.idModel, "subscriberId", listener.SubscriberId, "missed", gap.Missed, "truncated", gap.Truncated)
+			listener.GapHandler(listener.TrelloEventCtx, gap)
+			for _, action := range pending {
+				listener.cursor.mark(action)
 			}
+			listener.LastActionId = gap.LastActionId
+			return true
 		}
 	}
+	for _, action := range pending {
+		listener.Handler(listener.TrelloEventCtx, action)
+		listener.cursor.mark(action)
+		listener.LastActionId = action.ID
+	}
+	return true
+}
+
+// since returns the time of the oldest cursor of the board listeners, or a
+// zero time if none of them has a cursor.
+func (b *trelloBoard) since() time.Time {
+	since := time.Time{}
+	for _, listener := range b.listeners {
+		cursor := listener.cursor.time
+		if !cursor.IsZero() && (since.IsZero() || cursor.Before(since)) {
+			since = cursor
+		}
+	}
+	return since
+}
+
+// fetchActions returns the actions of a board made after the since cursor,
+// oldest first, paging through them. Without a cursor only the latest action
+// of the board is fetched, whatever its type, to start the cursors from it. It reports whether there were more actions than maxCatchUpPages
+// pages, the oldest ones are then left out.
+func (hub *TrelloEventHub) fetchActions(ctx context.Context, boardId string, events []string, since time.Time) ([]*trello.Action, bool, error) {
+	trelloBoard := trello.Board{ID: boardId}
+	trelloBoard.SetClient(hub.Client.WithContext(ctx))
+	args := trello.Arguments{
+		"filter": strings.Join(events, ","),
+		"limit":  strconv.Itoa(trelloActionPageSize),
+	}
+	if !since.IsZero() {
+		// The actions made at the cursor time are fetched again, the
+		// listeners skip the ones they have seen
+		args["since"] = since.Add(-time.Millisecond).UTC().Format(time.RFC3339Nano)
+	} else {
+		delete(args, "filter")
+		args["limit"] = "1"
+	}
+	// Trello returns the newest actions first
+	newest := []*trello.Action{}
+	truncated := true
+	for page := 0; page < maxCatchUpPages; page++ {
+		actions, err := trelloBoard.GetActions(args)
+		if err != nil {
+			return nil, false, err
+		}
+		newest = append(newest, actions...)
+		if since.IsZero() || len(actions) < trelloActionPageSize {
+			truncated = false
+			break
+		}
+		args["before"] = actions[len(actions)-1].ID
+	}
+	sortActions(newest)
+	return newest, truncated, nil
+}
+
+// pollBoard fetches the actions of a board since the oldest cursor of its
+// listeners and dispatches them. It reports whether the board had new
+// actions.
+func (hub *TrelloEventHub) pollBoard(ctx context.Context, board *trelloBoard) bool {
+	hub.mtx.Lock()
+	events := board.enabledEvents()
+	since := board.since()
+	hub.mtx.Unlock()
+	actions, truncated, err := hub.fetchActions(ctx, board.idModel, events, since)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Error("Could not fetch board events", "boardId", board.idModel, "err", err)
+		}
+		return false
+	}
+	hub.startListeners(board, actions, since)
+	return len(actions) > 0 && hub.dispatchActions(board, actions, truncated, true)
+}
+
+// startListeners starts the cursors of the listeners subscribed without one
+// from the latest fetched action, without delivering anything: the history of
+// the board is not replayed to a new subscriber. Without any fetched action
+// they start from the since cursor of the poll, every later action is new.
+func (hub *TrelloEventHub) startListeners(board *trelloBoard, actions []*trello.Action, since time.Time) {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+	for _, listener := range board.listeners {
+		if !listener.cursor.time.IsZero() {
+			continue
+		}
+		for _, action := range actions {
+			listener.cursor.advance(action)
+		}
+		if listener.cursor.time.IsZero() {
+			listener.cursor.time = since
+		}
+	}
+}
+
+// schedule sets the next poll of a board, the interval is reset to the
+// minimum when the board is active and doubled up to the maximum otherwise.
+// Boards with a webhook are polled at the maximum interval, in case Trello
+// disabled the webhook after failed callbacks.
+func (hub *TrelloEventHub) schedule(board *trelloBoard, active bool) {
+	if board.webhook != nil {
+		board.interval = hub.maxPollInterval
+	} else if active {
+		board.interval = hub.pollInterval
+	} else if board.interval *= 2; board.interval > hub.maxPollInterval {
+		board.interval = hub.maxPollInterval
+	}
+	board.nextPoll = time.Now().Add(board.interval)
+}
+
+// pollEvents fetches the boards due for a poll concurrently, at most
+// maxPollWorkers at a time. It does not wait for the fetches, a board still
+// being fetched from a previous poll is skipped.
+func (hub *TrelloEventHub) pollEvents(ctx context.Context) {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+	now := time.Now()
+	for _, board := range hub.boards {
+		if board.polling {
+			continue
+		}
+		if !board.forcePoll && now.Before(board.nextPoll) {
+			continue
+		}
+		board.polling = true
+		board.forcePoll = false
+		go func(board *trelloBoard) {
+			active := false
+			select {
+			case hub.pollWorkers <- struct{}{}:
+				active = hub.pollBoard(ctx, board)
+				<-hub.pollWorkers
+			case <-ctx.Done():
+			}
+			hub.mtx.Lock()
+			board.polling = false
+			hub.schedule(board, active)
+			forced := board.forcePoll
+			hub.mtx.Unlock()
+			if forced {
+				// Asked while the board was being fetched
+				hub.wakeUp()
+			}
+		}(board)
+	}
+}
+
+func (hub *TrelloEventHub) wakeUp() {
+	select {
+	case hub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// PollNow fetches the actions of a board right away, the board polling
+// interval is reset to the minimum.
+func (hub *TrelloEventHub) PollNow(idModel string) error {
+	hub.mtx.Lock()
+	board, exist := hub.boards[idModel]
+	if exist {
+		board.forcePoll = true
+		board.interval = hub.pollInterval
+	}
+	hub.mtx.Unlock()
+	if !exist {
+		return ErrBoardNotWatched
+	}
+	hub.wakeUp()
+	return nil
+}
+
+// PollStatus returns when a board is polled.
+func (hub *TrelloEventHub) PollStatus(idModel string) (*BoardPollStatus, error) {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+	board, exist := hub.boards[idModel]
+	if !exist {
+		return nil, ErrBoardNotWatched
+	}
+	return &BoardPollStatus{
+		Interval: board.interval,
+		NextPoll: board.nextPoll,
+		Webhook:  board.webhook != nil,
+	}, nil
+}
+
+// SetMaxPollInterval sets how far the polling of an idle board backs off, it
+// can not be lower than the poll interval.
+func (hub *TrelloEventHub) SetMaxPollInterval(maxInterval time.Duration) {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+	if maxInterval < hub.pollInterval {
+		maxInterval = hub.pollInterval
+	}
+	hub.maxPollInterval = maxInterval
+}
+
+// EnableWebhook makes the hub receive board events from Trello webhooks
+// instead of polling. Boards whose webhook could not be registered are still
+// polled until the registration succeeds. The secret is required, the
+// receiver would accept forged requests without it.
+func (hub *TrelloEventHub) EnableWebhook(listenAddr string, callbackURL string, secret string) error {
+	if secret == "" {
+		return ErrNoWebhookSecret
+	}
+	hub.webhook = &webhookReceiver{
+		hub:         hub,
+		listenAddr:  listenAddr,
+		callbackURL: strings.TrimSuffix(callbackURL, "/"),
+		secret:      secret,
+	}
+	return nil
 }
 
 func (hub *TrelloEventHub) Run(ctx context.Context) {
+	if hub.webhook != nil {
+		server := &http.Server{Addr: hub.webhook.listenAddr, Handler: hub.webhook}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Error("Webhook receiver stopped", "addr", server.Addr, "err", err)
+			}
+		}()
+		defer server.Close()
+		hub.webhook.loadWebhooks()
+	}
 	for {
 		select {
 		case <-time.After(hub.pollInterval):
-			hub.pollEvents()
+			if hub.webhook != nil {
+				hub.webhook.registerWebhooks()
+			}
+			hub.pollEvents(ctx)
+		case <-hub.wake:
+			hub.pollEvents(ctx)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// NewTrelloEventHub creates a hub polling the subscribed boards with the
+// client, the client is rate limited for every other use as well.
 func NewTrelloEventHub(client *trello.Client, pollInterval time.Duration) *TrelloEventHub {
-	return &TrelloEventHub{
+	limitTrelloClient(client)
+	hub := &TrelloEventHub{
 		Client:       client,
 		pollInterval: pollInterval,
-		listeners:    map[string]*TrelloEventListener{},
+		boards:       map[string]*trelloBoard{},
+		pollWorkers:  make(chan struct{}, maxPollWorkers),
+		wake:         make(chan struct{}, 1),
 	}
+	hub.SetMaxPollInterval(defaultMaxPollInterval)
+	return hub
 }
@@ -0,0 +1,258 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adlio/trello"
+	"golang.org/x/time/rate"
+)
+
+// newTrelloStandIn serves the board actions of a local Trello stand-in, every
+// board has the same single card creation.
+func newTrelloStandIn(t *testing.T) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if !strings.HasSuffix(r.URL.Path, "/actions") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"id":"640000000000000000000001","type":"createCard","date":"2023-03-02T01:46:40.000Z","data":{}}]`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func newTestHub(serverURL string) *TrelloEventHub {
+	client := trello.NewClient("key", "token")
+	client.BaseURL = serverURL
+	return NewTrelloEventHub(client, 5*time.Millisecond)
+}
+
+func TestTrelloEventHubConcurrentSubscriptions(t *testing.T) {
+	server, requests := newTrelloStandIn(t)
+	hub := newTestHub(server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	var delivered int32
+	handler := func(ctx *TrelloEventCtx, action *trello.Action) {
+		atomic.AddInt32(&delivered, 1)
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			subscriberId := fmt.Sprintf("channel%d", worker)
+			for idx := 0; idx < 50; idx++ {
+				boardId := fmt.Sprintf("board%d", idx%3)
+				if _, err := hub.Subscribe(boardId, subscriberId, []string{EventCreateCard}, "", handler, nil); err != nil {
+					t.Errorf("Subscribe(%s, %s) failed: %v", boardId, subscriberId, err)
+				}
+				if err := hub.SetEnabledEvents(boardId, subscriberId, []string{EventCreateCard, EventCommentCard}); err != nil {
+					t.Errorf("SetEnabledEvents(%s, %s) failed: %v", boardId, subscriberId, err)
+				}
+				hub.PollNow(boardId)
+				hub.Listeners()
+				time.Sleep(time.Millisecond)
+				hub.Unsubscribe(boardId, subscriberId)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	if len(hub.Listeners()) != 0 {
+		t.Errorf("expected no listener left, got %d", len(hub.Listeners()))
+	}
+	if atomic.LoadInt32(requests) == 0 {
+		t.Error("expected the boards to be polled")
+	}
+}
+
+func TestTrelloEventHubDeliversOnce(t *testing.T) {
+	server, _ := newTrelloStandIn(t)
+	hub := newTestHub(server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var delivered int32
+	handler := func(ctx *TrelloEventCtx, action *trello.Action) {
+		atomic.AddInt32(&delivered, 1)
+	}
+	if _, err := hub.Subscribe("board", "channel", []string{EventCreateCard}, "63fff0000000000000000000", handler, nil); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	go hub.Run(ctx)
+	for idx := 0; idx < 5; idx++ {
+		hub.PollNow("board")
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&delivered); got != 1 {
+		t.Errorf("expected the action to be delivered once, got %d", got)
+	}
+}
+
+func TestTrelloBoardSinceFollowsFilteredActions(t *testing.T) {
+	hub := newTestHub("http://127.0.0.1:0")
+	handler := func(ctx *TrelloEventCtx, action *trello.Action) {}
+	// The card creations listener saw nothing since its cursor, only comments
+	// were made on the board since then
+	if _, err := hub.Subscribe("board", "cards", []string{EventCreateCard}, "640000000000000000000000", handler, nil); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if _, err := hub.Subscribe("board", "comments", []string{EventCommentCard}, "640000000000000000000000", handler, nil); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	comments := []*trello.Action{}
+	for idx := 1; idx <= 3; idx++ {
+		comments = append(comments, &trello.Action{
+			ID:   fmt.Sprintf("64000%03d0000000000000000", idx),
+			Type: EventCommentCard,
+			Date: time.Unix(0x64000000+int64(idx)*0x1000, 0),
+		})
+	}
+	board := hub.boards["board"]
+	hub.dispatchActions(board, comments, false, true)
+	newest := comments[len(comments)-1].Date
+	if since := board.since(); !since.Equal(newest) {
+		t.Errorf("expected since to follow the fetched actions to %v, got %v", newest, since)
+	}
+}
+
+func TestTrelloPollRecoversActionsSkippedByWebhook(t *testing.T) {
+	hub := newTestHub("http://127.0.0.1:0")
+	delivered := []string{}
+	handler := func(ctx *TrelloEventCtx, action *trello.Action) {
+		delivered = append(delivered, action.ID)
+	}
+	if _, err := hub.Subscribe("board", "channel", []string{EventCreateCard}, "640000000000000000000000", handler, nil); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	first := &trello.Action{ID: "640000010000000000000000", Type: EventCreateCard, Date: time.Unix(0x64000001, 0)}
+	second := &trello.Action{ID: "640000020000000000000000", Type: EventCreateCard, Date: time.Unix(0x64000002, 0)}
+	board := hub.boards["board"]
+	// The webhook pushed the second action only, the fallback poll fetches both
+	hub.dispatch(board, second)
+	hub.dispatchActions(board, []*trello.Action{first, second}, false, true)
+	want := []string{second.ID, first.ID}
+	if strings.Join(delivered, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v to be delivered, got %v", want, delivered)
+	}
+	if since := board.since(); !since.Equal(second.Date) {
+		t.Errorf("expected since to follow the polled actions to %v, got %v", second.Date, since)
+	}
+}
+
+func TestTrelloNewListenerStartsFromLatestAction(t *testing.T) {
+	server, _ := newTrelloStandIn(t)
+	hub := newTestHub(server.URL)
+	delivered := []string{}
+	handler := func(ctx *TrelloEventCtx, action *trello.Action) {
+		delivered = append(delivered, action.ID)
+	}
+	if _, err := hub.Subscribe("board", "channel", []string{EventCreateCard}, "", handler, nil); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	board := hub.boards["board"]
+	hub.pollBoard(context.Background(), board)
+	if len(delivered) != 0 {
+		t.Errorf("expected the board history not to be delivered, got %v", delivered)
+	}
+	latest := time.Date(2023, 3, 2, 1, 46, 40, 0, time.UTC)
+	if since := board.since(); !since.Equal(latest) {
+		t.Errorf("expected the cursor to start from the latest action at %v, got %v", latest, since)
+	}
+	next := &trello.Action{ID: "640000010000000000000000", Type: EventCreateCard, Date: latest.Add(time.Second)}
+	hub.dispatchActions(board, []*trello.Action{next}, false, true)
+	if len(delivered) != 1 || delivered[0] != next.ID {
+		t.Errorf("expected the next action to be delivered, got %v", delivered)
+	}
+}
+
+// newPagingStandIn serves the given number of createCard actions, one per
+// second, paged like Trello: newest first, filtered by since and before.
+func newPagingStandIn(t *testing.T, count int) (*httptest.Server, func(idx int) *trello.Action) {
+	action := func(idx int) *trello.Action {
+		return &trello.Action{
+			ID:   fmt.Sprintf("%08x%016x", 0x64000000+idx, 0),
+			Type: EventCreateCard,
+			Date: time.Unix(int64(0x64000000+idx), 0).UTC(),
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		since, _ := time.Parse(time.RFC3339Nano, query.Get("since"))
+		page := []string{}
+		for idx := count - 1; idx >= 0 && len(page) < limit; idx-- {
+			a := action(idx)
+			if before := query.Get("before"); before != "" && a.ID >= before {
+				continue
+			}
+			if !a.Date.After(since) {
+				break
+			}
+			page = append(page, fmt.Sprintf(`{"id":%q,"type":%q,"date":%q,"data":{}}`, a.ID, a.Type, a.Date.Format(time.RFC3339Nano)))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "[%s]", strings.Join(page, ","))
+	}))
+	t.Cleanup(server.Close)
+	return server, action
+}
+
+func TestTrelloPollPagesMissedActions(t *testing.T) {
+	tests := []struct {
+		name          string
+		count         int
+		wantMissed    int
+		wantTruncated bool
+	}{
+		{"missed actions within the pages", 2*trelloActionPageSize + 50, 2*trelloActionPageSize + 50, false},
+		{"more actions than the pages", maxCatchUpPages*trelloActionPageSize + 50, maxCatchUpPages * trelloActionPageSize, true},
+	}
+	for _, test := range tests {
+		server, action := newPagingStandIn(t, test.count)
+		hub := newTestHub(server.URL)
+		hub.Client.Client.Transport.(*rateLimitedTransport).limiter.SetLimit(rate.Inf)
+		gaps := []*TrelloGap{}
+		handler := func(ctx *TrelloEventCtx, action *trello.Action) {
+			t.Errorf("%s: expected a gap instead of action %s", test.name, action.ID)
+		}
+		gapHandler := func(ctx *TrelloEventCtx, gap *TrelloGap) {
+			gaps = append(gaps, gap)
+		}
+		// The cursor is older than every served action
+		if _, err := hub.Subscribe("board", "channel", []string{EventCreateCard}, "63ffffff0000000000000000", handler, gapHandler); err != nil {
+			t.Fatalf("%s: Subscribe failed: %v", test.name, err)
+		}
+		board := hub.boards["board"]
+		hub.pollBoard(context.Background(), board)
+		newest := action(test.count - 1)
+		if len(gaps) != 1 {
+			t.Fatalf("%s: expected one gap, got %d", test.name, len(gaps))
+		}
+		if gaps[0].Missed != test.wantMissed || gaps[0].Truncated != test.wantTruncated || gaps[0].LastActionId != newest.ID {
+			t.Errorf("%s: got gap %+v, want %d missed, truncated %v, last action %s", test.name, gaps[0], test.wantMissed, test.wantTruncated, newest.ID)
+		}
+		if since := board.since(); !since.Equal(newest.Date) {
+			t.Errorf("%s: expected the cursor to move to the newest action at %v, got %v", test.name, newest.Date, since)
+		}
+		// The next poll has nothing new
+		hub.pollBoard(context.Background(), board)
+		if len(gaps) != 1 {
+			t.Errorf("%s: expected no new gap on the next poll, got %d gaps", test.name, len(gaps))
+		}
+	}
+}
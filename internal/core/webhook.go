@@ -0,0 +1,175 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/adlio/trello"
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	webhookRetryInterval = 1 * time.Minute
+	webhookMaxBodySize   = 1 << 20
+)
+
+// webhookReceiver registers a Trello webhook for every subscribed board and
+// feeds the pushed actions into the hub. Each board gets its own callback url
+// (<callbackURL>/<idModel>) so the receiver knows which board an incoming
+// action belongs to.
+type webhookReceiver struct {
+	hub         *TrelloEventHub
+	listenAddr  string
+	callbackURL string
+	secret      string
+}
+
+func (wr *webhookReceiver) boardCallbackURL(idModel string) string {
+	return fmt.Sprintf("%s/%s", wr.callbackURL, idModel)
+}
+
+// verifySignature checks the X-Trello-Webhook header, which is the base64
+// encoded HMAC-SHA1 of the request body followed by the callback url, keyed
+// with the application secret.
+func (wr *webhookReceiver) verifySignature(body []byte, callbackURL string, signature string) bool {
+	mac := hmac.New(sha1.New, []byte(wr.secret))
+	mac.Write(body)
+	mac.Write([]byte(callbackURL))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// loadWebhooks adopts the webhooks registered by a previous run, Trello
+// refuses to create a second webhook with the same model and callback url.
+// The webhooks Trello disabled are deleted so they are registered again. The
+// adopted boards are polled once to catch up with the actions made while the
+// bot was stopped.
+func (wr *webhookReceiver) loadWebhooks() {
+	webhooks := []*trello.Webhook{}
+	apiPath := fmt.Sprintf("tokens/%s/webhooks", wr.hub.Client.Token)
+	if err := wr.hub.Client.Get(apiPath, trello.Defaults(), &webhooks); err != nil {
+		log.Error("Could not fetch registered webhooks", "err", err)
+		return
+	}
+	wr.hub.mtx.Lock()
+	defer wr.hub.mtx.Unlock()
+	for _, webhook := range webhooks {
+		board, exist := wr.hub.boards[webhook.IDModel]
+		if !exist || webhook.CallbackURL != wr.boardCallbackURL(webhook.IDModel) {
+			continue
+		}
+		webhook.SetClient(wr.hub.Client)
+		if !webhook.Active {
+			log.Warn("Deleting disabled board webhook", "boardId", webhook.IDModel, "webhookId", webhook.ID)
+			if err := webhook.Delete(); err != nil {
+				log.Error("Could not delete board webhook", "boardId", webhook.IDModel, "webhookId", webhook.ID, "err", err)
+			}
+			continue
+		}
+		board.webhook = webhook
+		board.forcePoll = true
+		log.Info("Using existing board webhook", "boardId", webhook.IDModel, "webhookId", webhook.ID)
+	}
+}
+
+// registerWebhooks creates the missing webhooks of subscribed boards. A board
+// is polled until its webhook is registered, and once more right after so the
+// actions made during the registration are not missed.
+func (wr *webhookReceiver) registerWebhooks() {
+	now := time.Now()
+	missing := []*trelloBoard{}
+	wr.hub.mtx.Lock()
+	for _, board := range wr.hub.boards {
+		if board.webhook == nil && !now.Before(board.webhookRetryAt) {
+			missing = append(missing, board)
+		}
+	}
+	wr.hub.mtx.Unlock()
+	for _, board := range missing {
+		webhook := &trello.Webhook{
+			IDModel:     board.idModel,
+			Description: "dgtrello board events",
+			CallbackURL: wr.boardCallbackURL(board.idModel),
+		}
+		err := wr.hub.Client.CreateWebhook(webhook)
+		wr.hub.mtx.Lock()
+		subscribed := wr.hub.boards[board.idModel] == board
+		if err != nil {
+			board.webhookRetryAt = now.Add(webhookRetryInterval)
+		} else if subscribed {
+			board.webhook = webhook
+			board.forcePoll = true
+		}
+		wr.hub.mtx.Unlock()
+		if err != nil {
+			log.Error("Could not register board webhook, fallback to polling", "boardId", board.idModel, "err", err)
+			continue
+		}
+		if !subscribed {
+			// The board was unsubscribed while the webhook was being created
+			if err := webhook.Delete(); err != nil {
+				log.Error("Could not delete board webhook", "boardId", board.idModel, "webhookId", webhook.ID, "err", err)
+			}
+			continue
+		}
+		log.Info("Registered board webhook", "boardId", board.idModel, "webhookId", webhook.ID)
+	}
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Trello sends a HEAD request to verify the callback url on registration
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, webhookMaxBodySize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	idModel := path.Base(r.URL.Path)
+	if !wr.verifySignature(body, wr.boardCallbackURL(idModel), r.Header.Get("X-Trello-Webhook")) {
+		log.Warn("Rejected webhook request with invalid signature", "boardId", idModel, "remoteAddr", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	wr.hub.mtx.Lock()
+	board, exist := wr.hub.boards[idModel]
+	wr.hub.mtx.Unlock()
+	if !exist {
+		// Trello removes the webhook when the callback responds with 410
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	req := &trello.BoardWebhookRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		log.Error("Could not decode webhook request", "boardId", idModel, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if req.Action == nil {
+		return
+	}
+	wr.hub.dispatch(board, req.Action)
+}
+
+func containsString(arr []string, str string) bool {
+	for _, item := range arr {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/adlio/trello"
+)
+
+const testWebhookSecret = "secret"
+
+func signWebhookRequest(body []byte, callbackURL string, secret string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body)
+	mac.Write([]byte(callbackURL))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestEnableWebhookRequiresSecret(t *testing.T) {
+	hub := newTestHub("http://127.0.0.1:0")
+	if err := hub.EnableWebhook(":0", "https://example.com/trello", ""); err != ErrNoWebhookSecret {
+		t.Errorf("expected ErrNoWebhookSecret, got %v", err)
+	}
+	if hub.webhook != nil {
+		t.Error("expected the webhook receiver to stay disabled")
+	}
+}
+
+func TestWebhookReceiver(t *testing.T) {
+	hub := newTestHub("http://127.0.0.1:0")
+	// The stand-in plays Trello posting to the callback url
+	receiver := httptest.NewServer(nil)
+	defer receiver.Close()
+	if err := hub.EnableWebhook(":0", receiver.URL, testWebhookSecret); err != nil {
+		t.Fatalf("EnableWebhook failed: %v", err)
+	}
+	receiver.Config.Handler = hub.webhook
+
+	var delivered int32
+	handler := func(ctx *TrelloEventCtx, action *trello.Action) {
+		atomic.AddInt32(&delivered, 1)
+	}
+	if _, err := hub.Subscribe("board", "channel", []string{EventCreateCard}, "", handler, nil); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	body := []byte(`{"action":{"id":"640000000000000000000001","type":"createCard","date":"2023-03-02T00:00:00.000Z","data":{}}}`)
+	tests := []struct {
+		name       string
+		boardId    string
+		secret     string
+		wantStatus int
+		wantCount  int32
+	}{
+		{"valid signature", "board", testWebhookSecret, http.StatusOK, 1},
+		{"bad signature", "board", "forged", http.StatusUnauthorized, 1},
+		{"unknown board", "other", testWebhookSecret, http.StatusGone, 1},
+	}
+	for _, test := range tests {
+		callbackURL := hub.webhook.boardCallbackURL(test.boardId)
+		req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: could not create request: %v", test.name, err)
+		}
+		req.Header.Set("X-Trello-Webhook", signWebhookRequest(body, callbackURL, test.secret))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", test.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.wantStatus, resp.StatusCode)
+		}
+		if got := atomic.LoadInt32(&delivered); got != test.wantCount {
+			t.Errorf("%s: expected %d delivered actions, got %d", test.name, test.wantCount, got)
+		}
+	}
+}